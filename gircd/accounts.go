@@ -0,0 +1,129 @@
+package gircd
+
+import "crypto/sha256"
+import "encoding/hex"
+import "strings"
+import "sync"
+
+// Stores user accounts, and checks the credentials clients log in with
+type AccountBackend interface {
+	// Returns the name of the account if `password` is right for `name`
+	CheckPassword(name string, password string) (string, bool)
+
+	// Returns the name of the account a TLS certificate fingerprint (hex
+	//  encoded SHA-256) is registered to
+	FindByCertFP(fp string) (string, bool)
+}
+
+// Account backends that accounts can be removed from, see RemoveAccount
+type AccountRemover interface {
+	// Removes account `name`, returns false if there is no such account
+	Remove(name string) bool
+}
+
+// A user account, passwords are only kept as SCRAM credentials
+type Account struct {
+	Name    string
+	Creds   *SCRAMCredentials
+	CertFPs []string
+}
+
+// Account backend that keeps everything in memory, accounts are looked up
+// case insensitively
+type MemoryAccounts struct {
+	Accounts map[string]*Account
+	Lock     *sync.RWMutex
+}
+
+func NewMemoryAccounts() *MemoryAccounts {
+	return &MemoryAccounts{
+		Accounts: make(map[string]*Account),
+		Lock:     new(sync.RWMutex),
+	}
+}
+
+// Creates (or replaces) account `name` with a password
+func (a *MemoryAccounts) Add(name string, password string) *Account {
+	acc := &Account{
+		Name:    name,
+		Creds:   NewSCRAMCredentials(password, nil, SCRAM_ITERATIONS),
+		CertFPs: make([]string, 0),
+	}
+
+	a.Lock.Lock()
+	a.Accounts[strings.ToLower(name)] = acc
+	a.Lock.Unlock()
+	return acc
+}
+
+// Registers a certificate fingerprint to account `name`, used by SASL EXTERNAL
+func (a *MemoryAccounts) AddCertFP(name string, fp string) bool {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+
+	acc, has := a.Accounts[strings.ToLower(name)]
+	if !has {
+		return false
+	}
+	acc.CertFPs = append(acc.CertFPs, strings.ToLower(fp))
+	return true
+}
+
+// Returns account `name`, or nil
+func (a *MemoryAccounts) Get(name string) *Account {
+	a.Lock.RLock()
+	defer a.Lock.RUnlock()
+	return a.Accounts[strings.ToLower(name)]
+}
+
+func (a *MemoryAccounts) CheckPassword(name string, password string) (string, bool) {
+	acc := a.Get(name)
+	if acc == nil {
+		return "", false
+	}
+
+	if !acc.Creds.Check(password) {
+		return "", false
+	}
+	return acc.Name, true
+}
+
+func (a *MemoryAccounts) FindSCRAMCredentials(name string) (string, *SCRAMCredentials, bool) {
+	acc := a.Get(name)
+	if acc == nil {
+		return "", nil, false
+	}
+	return acc.Name, acc.Creds, true
+}
+
+func (a *MemoryAccounts) Remove(name string) bool {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+
+	if _, has := a.Accounts[strings.ToLower(name)]; !has {
+		return false
+	}
+	delete(a.Accounts, strings.ToLower(name))
+	return true
+}
+
+func (a *MemoryAccounts) FindByCertFP(fp string) (string, bool) {
+	a.Lock.RLock()
+	defer a.Lock.RUnlock()
+
+	fp = strings.ToLower(fp)
+	for _, acc := range a.Accounts {
+		for _, v := range acc.CertFPs {
+			if v == fp {
+				return acc.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the hex encoded SHA-256 fingerprint of a DER certificate
+func CertFP(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package gircd
+
+// Enum: Batch types
+const (
+	BATCH_CHATHISTORY         = "chathistory"
+	BATCH_CHATHISTORY_TARGETS = "draft/chathistory-targets"
+	BATCH_LABELED_RESPONSE    = "labeled-response"
+)
+
+// A batch of responses sent to a single client, clients without the batch
+// capability get the responses without the BATCH lines around them
+type Batch struct {
+	Ref    string
+	Type   string
+	Client *Client
+
+	// The batch this one is nested in, or nil
+	Parent *Batch
+}
+
+// Opens a batch of type `typ` for the client
+func (c *Client) StartBatch(typ string, params ...string) *Batch {
+	b := c.newBatch(nil, typ)
+	b.begin(params).Send()
+	return b
+}
+
+// Opens a batch nested in this one
+func (b *Batch) Start(typ string, params ...string) *Batch {
+	child := b.Client.newBatch(b, typ)
+	child.begin(params).Send()
+	return child
+}
+
+func (c *Client) newBatch(parent *Batch, typ string) *Batch {
+	return &Batch{
+		Ref:    c.Server.NewMsgID(),
+		Type:   typ,
+		Client: c,
+		Parent: parent,
+	}
+}
+
+// Builds the line that opens the batch
+func (b *Batch) begin(params []string) *Response {
+	r := b.line().SetF("+%s", b.Ref).Set(b.Type)
+	for _, v := range params {
+		r.Set(v)
+	}
+	return r
+}
+
+// Builds a BATCH line, which is itself part of the parent batch if nested
+func (b *Batch) line() *Response {
+	r := b.Client.ServerCmd(CLIENT_BATCH).RequireCap(CAP_BATCH)
+	if b.Parent != nil {
+		r.SetTag(TAG_BATCH, b.Parent.Ref)
+	}
+	return r
+}
+
+// Sends response `r` as part of the batch
+func (b *Batch) Send(r *Response) {
+	r.SetTag(TAG_BATCH, b.Ref).SendTo(b.Client)
+}
+
+// Closes the batch
+func (b *Batch) End() {
+	b.line().SetF("-%s", b.Ref).Send()
+}
+
+// A line captured for a labeled response, with the tags its recipient gets
+type labeledLine struct {
+	Tags map[string]string
+	Line string
+}
+
+// The replies to a command sent with a `label` tag, they are held back until
+// the command is done so they can be sent as a whole (see FlushLabel)
+type LabeledReply struct {
+	Label string
+	Lines []labeledLine
+}
+
+// Holds back the replies to the current command under `label`, if the client
+// negotiated labeled-response
+func (c *Client) StartLabel(label string) {
+	if label == "" || !c.HasCap(CAP_LABELED_RESPONSE) {
+		return
+	}
+	c.Label = &LabeledReply{Label: label}
+}
+
+// Sends the replies held back by StartLabel. A single reply gets the label,
+// several are wrapped in a labeled-response batch, and no reply at all is
+// acknowledged with ACK. Several replies to a client without batch are sent
+// without the label, there is nothing to put it on
+func (c *Client) FlushLabel() {
+	reply := c.Label
+	if reply == nil {
+		return
+	}
+	c.Label = nil
+
+	switch len(reply.Lines) {
+	case 0:
+		c.ServerCmd(CLIENT_ACK).SetTag(TAG_LABEL, reply.Label).Send()
+	case 1:
+		v := reply.Lines[0]
+		v.Tags[TAG_LABEL] = reply.Label
+		c.Write(formatLine(v.Tags, v.Line))
+	default:
+		if !c.HasCap(CAP_BATCH) {
+			for _, v := range reply.Lines {
+				c.Write(formatLine(v.Tags, v.Line))
+			}
+			break
+		}
+
+		// The label goes on the line opening the batch
+		b := c.newBatch(nil, BATCH_LABELED_RESPONSE)
+		b.begin(nil).SetTag(TAG_LABEL, reply.Label).Send()
+		for _, v := range reply.Lines {
+			// Lines of a nested batch already belong to it
+			if _, has := v.Tags[TAG_BATCH]; !has {
+				v.Tags[TAG_BATCH] = b.Ref
+			}
+			c.Write(formatLine(v.Tags, v.Line))
+		}
+		b.End()
+	}
+}
+
+// Holds back response `r` if the client is in the middle of a labeled
+// command, returns false if it should be sent as usual
+func (c *Client) captureLabeled(r *Response) bool {
+	if c.Label == nil {
+		return false
+	}
+
+	c.Label.Lines = append(c.Label.Lines, labeledLine{r.TagsFor(c), r.Build()})
+	return true
+}
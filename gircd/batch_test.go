@@ -0,0 +1,62 @@
+package gircd
+
+import "strings"
+import "testing"
+
+func TestLabeledResponse(t *testing.T) {
+	s := newTestServer()
+	plain, plainConn := newTestClient(s, "plain", CAP_LABELED_RESPONSE)
+	batched, batchedConn := newTestClient(s, "batched", CAP_LABELED_RESPONSE, CAP_BATCH)
+
+	// Single replies and ACK don't need batch
+	for _, cl := range []*Client{plain, batched} {
+		conn := plainConn
+		if cl == batched {
+			conn = batchedConn
+		}
+
+		testSend(cl, "@label=one PING x")
+		want := "@label=one :irc.test PONG irc.test :x"
+		if got := conn.Lines(); len(got) != 1 || got[0] != want {
+			t.Errorf("%s single reply: got %q, want %q", cl.Nick, got, want)
+		}
+
+		testSend(cl, "@label=none PONG x")
+		want = "@label=none :irc.test ACK"
+		if got := conn.Lines(); len(got) != 1 || got[0] != want {
+			t.Errorf("%s no reply: got %q, want %q", cl.Nick, got, want)
+		}
+	}
+
+	// Several replies are batched, or sent as usual without batch
+	testSend(batched, "@label=many LUSERS")
+	got := batchedConn.Lines()
+	if len(got) < 3 || !strings.HasPrefix(got[0], "@label=many :irc.test BATCH +") ||
+		!strings.Contains(got[len(got)-1], " BATCH -") {
+		t.Errorf("batched: got %q, want a labeled-response batch", got)
+	}
+
+	testSend(plain, "@label=many LUSERS")
+	got = plainConn.Lines()
+	if len(got) < 2 || hasLine(got, "label=") || hasLine(got, "BATCH") {
+		t.Errorf("without batch: got %q, want the replies without label or batch", got)
+	}
+}
+
+func TestInputTooLongWhileLabeled(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_LABELED_RESPONSE, CAP_BATCH)
+
+	// A labeled command is being handled by the parse loop, while the read
+	//  loop gets a line with too many tags
+	alice.StartLabel("busy")
+	alice.Feed([]byte("@+a=" + strings.Repeat("x", MAX_TAGS_SIZE) + " PING x\r\n"))
+
+	if got := conn.Lines(); len(got) != 1 || !strings.Contains(got[0], " 417 alice ") {
+		t.Errorf("got %q, want ERR_INPUTTOOLONG written right away", got)
+	}
+	if n := len(alice.Label.Lines); n != 0 {
+		t.Errorf("%d lines caught up in the labeled response", n)
+	}
+	alice.FlushLabel()
+}
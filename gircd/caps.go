@@ -0,0 +1,278 @@
+package gircd
+
+import "strings"
+import "sync"
+
+// Enum: IRCv3 Capabilities
+const (
+	CAP_AWAY_NOTIFY  = "away-notify"
+	CAP_CAP_NOTIFY   = "cap-notify"
+	CAP_SASL         = "sasl"
+	CAP_MESSAGE_TAGS = "message-tags"
+	CAP_SERVER_TIME  = "server-time"
+	CAP_BATCH        = "batch"
+	CAP_CHATHISTORY  = "draft/chathistory"
+
+	CAP_LABELED_RESPONSE = "labeled-response"
+	CAP_STANDARD_REPLIES = "standard-replies"
+	CAP_EXTENDED_JOIN    = "extended-join"
+	CAP_MULTI_PREFIX     = "multi-prefix"
+	CAP_USERHOST_NAMES   = "userhost-in-names"
+	CAP_ACCOUNT_NOTIFY   = "account-notify"
+	CAP_CHGHOST          = "chghost"
+	CAP_SETNAME          = "setname"
+)
+
+// CAP LS version that enables values and multi-line replies
+const CAP_VERSION_302 = 302
+
+// A capability the server offers, Value is only sent to CAP LS 302 clients
+type Capability struct {
+	Name  string
+	Value string
+}
+
+// Returns the capability as sent in CAP LS/NEW (e.g. `sasl=PLAIN`)
+func (c Capability) String(values bool) string {
+	if !values || c.Value == "" {
+		return c.Name
+	}
+	return c.Name + "=" + c.Value
+}
+
+// Ordered set of capabilities offered to clients
+type CapSet struct {
+	Caps []Capability
+	Lock *sync.RWMutex
+}
+
+func NewCapSet() *CapSet {
+	return &CapSet{
+		Caps: make([]Capability, 0),
+		Lock: new(sync.RWMutex),
+	}
+}
+
+// Sets capability `name` to `value`, replacing any existing value
+func (s *CapSet) Set(name string, value string) *CapSet {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	for idx, v := range s.Caps {
+		if v.Name == name {
+			s.Caps[idx].Value = value
+			return s
+		}
+	}
+	s.Caps = append(s.Caps, Capability{name, value})
+	return s
+}
+
+// Returns capability `name`, and whether it is offered
+func (s *CapSet) Get(name string) (Capability, bool) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+
+	for _, v := range s.Caps {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Capability{}, false
+}
+
+// Returns true if capability `name` is offered
+func (s *CapSet) Has(name string) bool {
+	_, has := s.Get(name)
+	return has
+}
+
+// Removes capability `name`
+func (s *CapSet) Rmv(name string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	for idx, v := range s.Caps {
+		if v.Name == name {
+			s.Caps = append(s.Caps[:idx], s.Caps[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Returns a copy of the capabilities
+func (s *CapSet) List() []Capability {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+
+	res := make([]Capability, len(s.Caps))
+	copy(res, s.Caps)
+	return res
+}
+
+// Returns the capabilities in `s` that are missing from (or have a different
+// value in) `other`
+func (s *CapSet) Diff(other *CapSet) []Capability {
+	res := make([]Capability, 0)
+	for _, v := range s.List() {
+		if o, has := other.Get(v.Name); !has || o.Value != v.Value {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Builds the list of capabilities from the config, a capability is offered
+// unless it is listed in DisabledCaps
+func (s *Server) BuildCaps() {
+	caps := NewCapSet()
+	for _, name := range []string{
+		CAP_AWAY_NOTIFY, CAP_CAP_NOTIFY, CAP_MESSAGE_TAGS, CAP_SERVER_TIME, CAP_BATCH,
+		CAP_LABELED_RESPONSE, CAP_STANDARD_REPLIES, CAP_EXTENDED_JOIN, CAP_MULTI_PREFIX,
+		CAP_USERHOST_NAMES, CAP_ACCOUNT_NOTIFY, CAP_CHGHOST, CAP_SETNAME,
+	} {
+		caps.Set(name, "")
+	}
+
+	// History is only offered if the server keeps it
+	if s.History != nil {
+		caps.Set(CAP_CHATHISTORY, "")
+	}
+
+	// SASL is only offered with somewhere to check accounts against
+	if mechs := s.SASLMechs(); len(mechs) > 0 {
+		caps.Set(CAP_SASL, strings.Join(mechs, ","))
+	}
+
+	for _, name := range s.DisabledCaps {
+		caps.Rmv(name)
+	}
+	s.Caps = caps
+}
+
+// Returns the names of the capabilities the client has enabled
+func (c *Client) CapList() []string {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	res := make([]string, 0, len(c.Caps))
+	for _, v := range c.Server.Caps.List() {
+		if c.Caps[v.Name] {
+			res = append(res, v.Name)
+		}
+	}
+	return res
+}
+
+// Enables or disables a capability for the client
+func (c *Client) SetCap(name string, enabled bool) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if enabled {
+		c.Caps[name] = true
+	} else {
+		delete(c.Caps, name)
+	}
+}
+
+// Sends a CAP reply, splitting `tokens` over as many lines as needed. On
+// CAP 302 every line but the last is marked with a `*` parameter
+func (c *Client) SendCapReply(sub string, tokens []string) {
+	// Room for the prefix, target, subcommand and the continuation marker
+	size := MAX_LINE_SIZE - len(c.Resp(CLIENT_CAP).Set(sub).Set("*").Set(":").Build())
+
+	multi := c.CapVersion >= CAP_VERSION_302
+	lines := JoinTokens(tokens, 0, size)
+	if !multi && len(lines) > 1 {
+		lines = []string{strings.Join(tokens, " ")}
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	for idx, line := range lines {
+		r := c.Resp(CLIENT_CAP).Set(sub)
+		if idx < len(lines)-1 {
+			r.Set("*")
+		}
+		r.SetF(":%s", line).Send()
+	}
+}
+
+// Handles CAP LS, which holds up registration until CAP END
+func (c *Client) CapLS(version int) {
+	if c.State == STATE_REGISTERING {
+		c.CapHold = true
+	}
+
+	// LS 302 implies cap-notify
+	if version > c.CapVersion {
+		c.CapVersion = version
+	}
+	if c.CapVersion >= CAP_VERSION_302 && c.Server.Caps.Has(CAP_CAP_NOTIFY) {
+		c.SetCap(CAP_CAP_NOTIFY, true)
+	}
+
+	tokens := make([]string, 0)
+	for _, v := range c.Server.Caps.List() {
+		tokens = append(tokens, v.String(c.CapVersion >= CAP_VERSION_302))
+	}
+	c.SendCapReply("LS", tokens)
+}
+
+// Handles CAP REQ, either every change in the request is applied (ACK) or
+// none of them are (NAK)
+func (c *Client) CapREQ(req string) {
+	if c.State == STATE_REGISTERING {
+		c.CapHold = true
+	}
+
+	changes := strings.Fields(req)
+	for _, v := range changes {
+		name := strings.TrimPrefix(v, "-")
+		if !c.Server.Caps.Has(name) {
+			c.Resp(CLIENT_CAP).Set("NAK").SetF(":%s", req).Send()
+			return
+		}
+	}
+
+	for _, v := range changes {
+		if strings.HasPrefix(v, "-") {
+			c.SetCap(v[1:], false)
+		} else {
+			c.SetCap(v, true)
+		}
+	}
+	c.Resp(CLIENT_CAP).Set("ACK").SetF(":%s", req).Send()
+}
+
+// Tells every cap-notify client about capabilities that were added (NEW) and
+// removed (DEL), removed capabilities are disabled for everyone
+func (s *Server) NotifyCaps(added []Capability, removed []Capability) {
+	for _, cl := range s.ClientList() {
+		for _, v := range removed {
+			cl.SetCap(v.Name, false)
+		}
+
+		if !cl.HasCap(CAP_CAP_NOTIFY) {
+			continue
+		}
+
+		if len(added) > 0 {
+			tokens := make([]string, 0, len(added))
+			for _, v := range added {
+				tokens = append(tokens, v.String(cl.CapVersion >= CAP_VERSION_302))
+			}
+			cl.SendCapReply("NEW", tokens)
+		}
+
+		if len(removed) > 0 {
+			tokens := make([]string, 0, len(removed))
+			for _, v := range removed {
+				tokens = append(tokens, v.Name)
+			}
+			cl.SendCapReply("DEL", tokens)
+		}
+	}
+}
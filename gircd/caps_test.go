@@ -0,0 +1,76 @@
+package gircd
+
+import "testing"
+
+func TestCapREQ(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+
+	tests := []struct {
+		Line string
+		Want string
+		Caps []string
+	}{
+		{"CAP REQ :server-time away-notify", ":irc.test CAP alice ACK :server-time away-notify",
+			[]string{CAP_AWAY_NOTIFY, CAP_SERVER_TIME}},
+		{"CAP REQ :-away-notify setname", ":irc.test CAP alice ACK :-away-notify setname",
+			[]string{CAP_SERVER_TIME, CAP_SETNAME}},
+
+		// One unknown capability refuses the whole request
+		{"CAP REQ :away-notify no-such-cap", ":irc.test CAP alice NAK :away-notify no-such-cap",
+			[]string{CAP_SERVER_TIME, CAP_SETNAME}},
+		{"CAP REQ :-server-time -no-such-cap", ":irc.test CAP alice NAK :-server-time -no-such-cap",
+			[]string{CAP_SERVER_TIME, CAP_SETNAME}},
+	}
+
+	for _, v := range tests {
+		testSend(alice, v.Line)
+		if got := conn.Lines(); len(got) != 1 || got[0] != v.Want {
+			t.Errorf("%q: got %q, want %q", v.Line, got, v.Want)
+		}
+
+		got := alice.CapList()
+		if len(got) != len(v.Caps) {
+			t.Errorf("%q: enabled %q, want %q", v.Line, got, v.Caps)
+			continue
+		}
+		for _, name := range v.Caps {
+			if !alice.HasCap(name) {
+				t.Errorf("%q: enabled %q, want %q", v.Line, got, v.Caps)
+			}
+		}
+	}
+}
+
+func TestCapNotifyRehash(t *testing.T) {
+	s := newTestServer()
+	oper, _ := newTestClient(s, "oper")
+	oper.GlobalOp = true
+	alice, aliceConn := newTestClient(s, "alice", CAP_CAP_NOTIFY, CAP_SETNAME)
+	bob, bobConn := newTestClient(s, "bob", CAP_SETNAME)
+
+	s.DisabledCaps = []string{CAP_SETNAME}
+	testSend(oper, "REHASH")
+	want := ":irc.test CAP alice DEL :setname"
+	if got := aliceConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("DEL: got %q, want %q", got, want)
+	}
+	if got := bobConn.Lines(); len(got) != 0 {
+		t.Errorf("client without cap-notify got %q", got)
+	}
+
+	// Removed capabilities are disabled, with or without cap-notify
+	if alice.HasCap(CAP_SETNAME) || bob.HasCap(CAP_SETNAME) {
+		t.Errorf("setname still enabled after it was removed")
+	}
+
+	s.DisabledCaps = nil
+	testSend(oper, "REHASH")
+	want = ":irc.test CAP alice NEW :setname"
+	if got := aliceConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("NEW: got %q, want %q", got, want)
+	}
+	if got := bobConn.Lines(); len(got) != 0 {
+		t.Errorf("client without cap-notify got %q", got)
+	}
+}
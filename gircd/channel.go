@@ -2,6 +2,8 @@ package gircd
 
 import "fmt"
 import "log"
+import "strings"
+import "sync"
 
 // Enum: Channel Name Prefixes
 const (
@@ -17,22 +19,41 @@ const (
 	CHAN_MODE_ANON      = "a"
 	CHAN_MODE_STICKY    = "g"
 	CHAN_MODE_MODERATED = "m"
+	CHAN_MODE_SECRET    = "s"
+	CHAN_MODE_KEY       = "k"
+)
+
+// Channel modes grouped by how they take parameters (ISUPPORT CHANMODES):
+// list modes, modes that always take one, modes that take one when set, and
+// plain flags
+const (
+	CHAN_MODES_LIST      = ""
+	CHAN_MODES_PARAM     = CHAN_MODE_KEY
+	CHAN_MODES_SET_PARAM = ""
+	CHAN_MODES_FLAG      = CHAN_MODE_ANON + CHAN_MODE_STICKY + CHAN_MODE_MODERATED + CHAN_MODE_SECRET
+)
+
+// Enum: Channel User Level Modes
+const (
+	CHAN_MODE_OP    = "o"
+	CHAN_MODE_VOICE = "v"
 )
 
 // Enum: Channel User Level Prefixes
 const (
-	CHAN_OP_PREFIX        = "@"
-	CHAN_VOICE_PREFIX     = "+"
-	CHAN_GLOBAL_OP_PREFIX = "&"
+	CHAN_OP_PREFIX    = "@"
+	CHAN_VOICE_PREFIX = "+"
 )
 
-// Returns true if `char` is an acceptable channel prefix
-func isChannelPrefix(char string) bool {
-	if char == CHAN_PREFIX_DEFAULT || char == CHAN_PREFIX_SERVER {
-		return true
-	}
-	return false
-}
+// Channel user levels, highest first, and their prefixes in the same order
+// (ISUPPORT PREFIX)
+const (
+	CHAN_USER_MODES    = CHAN_MODE_OP + CHAN_MODE_VOICE
+	CHAN_USER_PREFIXES = CHAN_OP_PREFIX + CHAN_VOICE_PREFIX
+)
+
+// Channel modes advertised in RPL_MYINFO
+const CHAN_MODES = CHAN_MODES_LIST + CHAN_MODES_PARAM + CHAN_MODES_SET_PARAM + CHAN_MODES_FLAG + CHAN_USER_MODES
 
 // Embedded struct containing channel details
 type ChannelInfo struct {
@@ -65,12 +86,12 @@ type Channel struct {
 	// Ref to server
 	Server *Server
 
-	// List of references to active members
-	Members     []*Client
-	MemberModes map[int]*MemberMode
+	// Active members, mapped to their flags on the channel
+	Members map[*Client]*MemberMode
+	Lock    *sync.RWMutex
 
 	// Messages Queue
-	Messages chan string
+	Messages chan *Response
 
 	Alive bool
 
@@ -84,9 +105,9 @@ func NewChannel(prefix string, name string, server *Server) *Channel {
 		Name:        name,
 		Key:         "",
 		Server:      server,
-		Members:     make([]*Client, 0),
-		MemberModes: make(map[int]*MemberMode, 0),
-		Messages:    make(chan string, 1),
+		Members:     make(map[*Client]*MemberMode),
+		Lock:        new(sync.RWMutex),
+		Messages:    make(chan *Response, 1),
 		ChannelInfo: NewChannelInfo(),
 		Alive:       true,
 	}
@@ -101,48 +122,63 @@ func NewChannelInfo() ChannelInfo {
 	}
 }
 
-// Checks if the client has a valid MemberMode stored yet
-func (c *Channel) HasModesMap(cl *Client) bool {
-	if _, c := c.MemberModes[cl.ID]; c {
-		return true
+// Returns the MemberMode for a client, non-members get a blank MemberMode
+func (c *Channel) GetModes(cl *Client) *MemberMode {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	if modes, ok := c.Members[cl]; ok {
+		return modes
 	}
-	return false
+	return &MemberMode{}
 }
 
-// Returns the MemberModes for a client, creating and returing a default
-//  MemberMode if one does not already exist
-//  NB: Do not call unless user IsMember, or we'll mem leak!
-func (c *Channel) GetModes(cl *Client) *MemberMode {
-	if !c.HasModesMap(cl) {
-		c.MemberModes[cl.ID] = &MemberMode{
-			Op:    false,
-			Voice: false,
-			Ghost: false,
-		}
+// Returns a snapshot of the channels members
+func (c *Channel) MemberList() []*Client {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	members := make([]*Client, 0, len(c.Members))
+	for v := range c.Members {
+		members = append(members, v)
 	}
-	return c.MemberModes[cl.ID]
+	return members
 }
 
-// Delete a MemberMode from the mapping (used when a clinet leaves)
-func (c *Channel) RmvModes(cl *Client) {
-	delete(c.MemberModes, cl.ID)
+// Returns the number of members on the channel
+func (c *Channel) MemberCount() int {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	return len(c.Members)
+}
+
+// Adds client `cl` as a member, the first member (who created the channel)
+// is made an op
+func (c *Channel) AddMember(cl *Client) {
+	c.Lock.Lock()
+	c.Members[cl] = &MemberMode{
+		Op:    len(c.Members) == 0,
+		Voice: false,
+		Ghost: false,
+	}
+	c.Lock.Unlock()
+	cl.AddChannel(c)
 }
 
 // A constant loop that is used to send channel-wide packets
 func (c *Channel) SendLoop() {
 	for msg := range c.Messages {
-		if !c.Alive {
+		// RmvChannel queues nil to stop the loop, as Alive is set from
+		//  another goroutine
+		if msg == nil {
 			return
 		}
-		c.LogF("Sending msg `%s` to `%d` members in `%s`", msg, len(c.Members), c.GetName())
-		for _, v := range c.Members {
-			v.Write(msg)
-		}
+		members := c.MemberList()
+		c.LogF("Sending `%s` to `%d` members in `%s`", msg.Tag, len(members), c.GetName())
+		msg.SendAll(members)
 	}
 }
 
 // Utility function to queue a message for sending
-func (c *Channel) Send(msg string) {
+func (c *Channel) Send(msg *Response) {
 	c.Messages <- msg
 }
 
@@ -151,55 +187,139 @@ func (c *Channel) GetName() string {
 	return c.Prefix + c.Name
 }
 
-// Returns a members full name
-func (c *Channel) GetMemberName(cl *Client) string {
+// Returns the prefix for a members highest user level (empty if none)
+func (c *Channel) GetMemberPrefix(cl *Client) string {
 	var prefix string = ""
 	modes := c.GetModes(cl)
 	if modes.Op {
 		prefix = CHAN_OP_PREFIX
 	} else if modes.Voice {
 		prefix = CHAN_VOICE_PREFIX
-	} else if cl.GlobalOp {
-		prefix = CHAN_GLOBAL_OP_PREFIX
 	}
-	return prefix + cl.Nick
+	return prefix
+}
+
+// Returns the prefixes for every user level of a member, highest first
+func (c *Channel) GetMemberPrefixes(cl *Client) string {
+	var prefix string = ""
+	modes := c.GetModes(cl)
+	if modes.Op {
+		prefix += CHAN_OP_PREFIX
+	}
+	if modes.Voice {
+		prefix += CHAN_VOICE_PREFIX
+	}
+	return prefix
+}
+
+// Returns the prefix of member `cl` as shown to client `to`, which gets all
+// of them if it has multi-prefix
+func (c *Channel) MemberPrefixFor(cl *Client, to *Client) string {
+	if to.HasCap(CAP_MULTI_PREFIX) {
+		return c.GetMemberPrefixes(cl)
+	}
+	return c.GetMemberPrefix(cl)
+}
+
+// Returns a members full name
+func (c *Channel) GetMemberName(cl *Client) string {
+	return c.GetMemberPrefix(cl) + cl.Nick
+}
+
+// Returns the name of member `cl` as listed to client `to` in NAMES, which
+// gets the full hostmask if it has userhost-in-names
+func (c *Channel) MemberNameFor(cl *Client, to *Client) string {
+	if to.HasCap(CAP_USERHOST_NAMES) {
+		return c.MemberPrefixFor(cl, to) + cl.GetHash()
+	}
+	return c.MemberPrefixFor(cl, to) + cl.Nick
+}
+
+// Builds the JOIN for client `cl`, clients with extended-join also get the
+// account (`*` if none) and realname
+func (c *Channel) JoinCmd(cl *Client) *Response {
+	join := cl.Cmd(CLIENT_JOIN).Set(c.GetName())
+	account := cl.Account
+	if account == "" {
+		account = "*"
+	}
+	return join.Variant(CAP_EXTENDED_JOIN, join.Copy().Set(account).SetF(":%s", cl.RealName))
+}
+
+// Builds the MODE giving member `cl` its user levels, nil if it has none
+func (c *Channel) MemberModeCmd(cl *Client) *Response {
+	modes := c.GetModes(cl)
+	var flags string = ""
+	if modes.Op {
+		flags += CHAN_MODE_OP
+	}
+	if modes.Voice {
+		flags += CHAN_MODE_VOICE
+	}
+	if flags == "" {
+		return nil
+	}
+
+	r := NewServerCommand(CLIENT_MODE, nil, c.Server).Set(c.GetName()).SetF("+%s", flags)
+	for range flags {
+		r.Set(cl.Nick)
+	}
+	return r
 }
 
 // Called when client `cl` wants to join the channel
 func (c *Channel) ClientJoin(cl *Client) {
-	if len(c.Members) > c.MaxMembers {
+	if count := c.MemberCount(); count > c.MaxMembers {
 		cl.Resp(ERR_CHANNELISFULL).Set(c.GetName()).SetF(":Channel is full (%d/%d members)",
-			len(c.Members), c.MaxMembers).Send()
+			count, c.MaxMembers).Send()
 		return
 	}
-	cl.Channels += 1
-	c.Members = append(c.Members, cl)
-	cl.Resp(CLIENT_JOIN).Set(c.GetName()).Chan(c)
+	c.AddMember(cl)
+
+	// The joining client gets its JOIN before the topic and names
+	join := c.JoinCmd(cl)
+	join.SendTo(cl)
+	join.Except(cl).Chan(c)
+
+	// Members with away-notify expect to learn whether the new member is away
+	if cl.Away != "" {
+		away := cl.Cmd(CLIENT_AWAY).SetF(":%s", cl.Away)
+		for _, v := range c.MemberList() {
+			if v != cl && v.HasCap(CAP_AWAY_NOTIFY) {
+				away.SendTo(v)
+			}
+		}
+	}
 	c.SendTopic(cl)
 	c.SendNames(cl)
 }
 
 // Called when client `cl` wants to part the channel with message `msg`
 func (c *Channel) ClientPart(cl *Client, msg string) {
-	// r u fukin srs m8
-	// fix ur fukin code ya scrub
-	new_members := make([]*Client, 0)
-	for _, v := range c.Members {
-		if v != cl {
-			new_members = append(new_members, v)
-		}
+	part := cl.Cmd(CLIENT_PART).Set(c.GetName())
+	if msg != "" {
+		part.SetF(":%s", msg)
 	}
-	c.Members = new_members
+	c.RmvMember(cl)
 
-	if len(c.Members) > 0 {
-		cl.Resp(CLIENT_PART).Set(c.GetName()).SetF(":%s", msg).Chan(c)
-		cl.Channels -= 1
+	// The parting client is no longer a member, so gets its PART directly
+	if c.MemberCount() > 0 {
+		part.Chan(c)
 	}
+	part.SendTo(cl)
+}
 
-	// Some geneirc GC stuff
-	c.RmvModes(cl)
+// Silently removes client `cl` from the channel (e.g. when it quits), and GCs
+// the channel if it is left empty
+func (c *Channel) RmvMember(cl *Client) {
+	c.Lock.Lock()
+	delete(c.Members, cl)
+	count := len(c.Members)
+	c.Lock.Unlock()
+	cl.RmvChannel(c)
 
-	if len(c.Members) == 0 && !c.Mode.HasMode(CHAN_MODE_STICKY) {
+	// Some geneirc GC stuff
+	if count == 0 && !c.Mode.HasMode(CHAN_MODE_STICKY) {
 		c.Log("Channel has 0 members and has no sticky mode set, GCing...")
 		c.Server.RmvChannel(c)
 	}
@@ -215,25 +335,27 @@ func (c *Channel) LogF(l string, vars ...interface{}) {
 	c.Log(fmt.Sprintf(l, vars...))
 }
 
-// Checks if `pw` is equal to the channel pw (default empty string)
+// Checks if `pw` is equal to the channel pw, channels without one (the
+// default) accept any pw
 func (c *Channel) CheckPassword(pw string) bool {
-	return (pw == c.Key)
+	return (c.Key == "" || pw == c.Key)
 }
 
 // Checks if client `cl` is a member of the channel
 func (c *Channel) IsMember(cl *Client) bool {
-	for _, v := range c.Members {
-		if v == cl {
-			return true
-		}
-	}
-	return false
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	_, ok := c.Members[cl]
+	return ok
 }
 
-// Sends the channels topic to client `cl`
+// Sends the channels topic to client `cl`, if one is set
 func (c *Channel) SendTopic(cl *Client) {
-	cl.Resp(RPL_TOPIC).Set(c.GetName()).Set(c.Topic.Topic)
-	cl.Resp(RPL_TOPICWHOTIME).Set(c.GetName()).Set(c.Topic.Nick).Set(c.Topic.Time)
+	if c.Topic.Topic == "" {
+		return
+	}
+	cl.Resp(RPL_TOPIC).Set(c.GetName()).SetF(":%s", c.Topic.Topic).Send()
+	cl.Resp(RPL_TOPICWHOTIME).Set(c.GetName()).Set(c.Topic.Nick).Set(c.Topic.Time).Send()
 }
 
 // Sends the channels name listing to client `cl`
@@ -241,14 +363,14 @@ func (c *Channel) SendNames(cl *Client) {
 	var base string = ""
 
 	send_base := func() {
-		cl.Resp(RPL_NAMREPLY).SetF("= %s", c.GetName()).Set(base).Send()
+		cl.Resp(RPL_NAMREPLY).Set("=").Set(c.GetName()).SetF(":%s", strings.TrimSpace(base)).Send()
 	}
 
 	// This loop makes 510 character long messages
 	// TODO: Bug, does not include the base message size in the max line
 	//  length. get size of packet.build() and subtract it from MAX_LINE_SIZE
-	for _, v := range c.Members {
-		name := c.GetMemberName(v)
+	for _, v := range c.MemberList() {
+		name := c.MemberNameFor(v, cl)
 		if len(base+name) > MAX_LINE_SIZE {
 			send_base()
 			base = ""
@@ -262,8 +384,9 @@ func (c *Channel) SendNames(cl *Client) {
 	cl.Resp(RPL_ENDOFNAMES).Set(c.GetName()).Set(":End of /NAMES list.").Send()
 }
 
-// Called when a client `cl` wants to send a message `msg` to the channel
-func (c *Channel) Message(cl *Client, msg string) {
+// Called when a client `cl` wants to send a message (PRIVMSG, NOTICE or
+// TAGMSG) `msg` to the channel, everyone but the sender gets it
+func (c *Channel) Message(cl *Client, msg *Response) {
 	// If the channel is in moderated mode, some clients cant chat
 	if c.Mode.HasMode(CHAN_MODE_MODERATED) {
 		if !(c.GetModes(cl).Voice || c.GetModes(cl).Op) {
@@ -271,6 +394,9 @@ func (c *Channel) Message(cl *Client, msg string) {
 			return
 		}
 	}
-	// TODO: do not send this to
-	cl.Resp(CLIENT_PRIVMSG).Set(c.GetName()).SetF(":%s", msg).Chan(c)
+	msg.Except(cl).Chan(c)
+
+	if msg.Tag != CLIENT_TAGMSG {
+		c.Server.AddHistory(c.Server.HistoryKey(c), msg)
+	}
 }
@@ -1,21 +1,37 @@
 package gircd
 
 import "net"
+import "crypto/subtle"
+import "crypto/tls"
 import "fmt"
 import "log"
 import "sync"
+import "sync/atomic"
 import "time"
 import "strings"
 
 // ENUM: ClientState
 const (
-	STATE_WAIT_PW = iota
-	STATE_WAIT_NICK
-	STATE_WAIT_USER
+	// Waiting for PASS/NICK/USER (in any order) and the end of CAP negotiation
+	STATE_REGISTERING = iota
 	STATE_ACTIVE
 	STATE_DEAD
 )
 
+// Enum: User Modes
+const (
+	USER_MODE_INVISIBLE = "i"
+)
+
+// User modes a client may set on itself
+const USER_MODES_SETTABLE = USER_MODE_INVISIBLE
+
+// User modes advertised in RPL_MYINFO
+const USER_MODES = USER_MODE_INVISIBLE
+
+// WHOX fields in the order they are sent in RPL_WHOSPCRPL
+const WHOX_FIELDS = "tcuihsnfdlaor"
+
 type ClientInfo struct {
 	// NICK
 	Nick string
@@ -26,10 +42,32 @@ type ClientInfo struct {
 	Unused   string
 	RealName string
 
+	// Account name the client is logged in to, empty if none
+	Account string
+
+	// Away message, empty if the client is not away
+	Away string
+
+	// Host the client is shown with (e.g. a cloak or vhost), empty to show
+	//  the address it connected from
+	Host string
+
 	GlobalOp bool
 
 	// Data to match PING and PONG
 	PingCode string
+
+	// Password sent with PASS during registration
+	Pass string
+
+	// Set while a CAP negotiation is holding up registration
+	CapHold bool
+
+	// AUTHENTICATE exchange in progress, if any
+	SASL *SASLSession
+
+	// Replies held back for the labeled command being handled, if any
+	Label *LabeledReply
 }
 
 type Client struct {
@@ -40,49 +78,69 @@ type Client struct {
 	Conn     net.Conn
 	LastPing time.Time
 
+	// When the connection was accepted
+	Connected time.Time
+
+	// Traffic counters for STATS l
+	Stats *ConnStats
+
+	// When the client finished registering, and when it last did something
+	//  other than PING/PONG (used for idle times)
+	Signon     time.Time
+	LastActive time.Time
+
 	// Data-plexes
 	Lock    *sync.RWMutex
 	Updates []*Update
 	MsgQ    chan *Msg
 
+	// Data read off the connection that doesn't make up a full line yet
+	RecvBuf string
+
 	// Used in rate-limiting
-	Messages int
+	Messages       int
+	LastNickChange time.Time
 
-	// Marks how many channels a client is in
-	Channels int
+	// Channels the client is a member of
+	Channels map[*Channel]bool
+
+	// IRCv3 capabilities the client has enabled, and the highest CAP LS
+	//  version it asked for
+	Caps       map[string]bool
+	CapVersion int
 
 	ClientInfo
 }
 
 var UPDATE_TIME = time.Millisecond * 350
 
+// How long a registered client has to wait between nick changes
+var NICK_CHANGE_DELAY = time.Second * 10
+
 // Called to create a new client, need an id, the server, and the network
 //  connection
 func NewClient(id int, server *Server, c net.Conn) *Client {
 	cli := &Client{
-		Conn:     c,
-		Server:   server,
-		ID:       id,
-		MsgQ:     make(chan *Msg, 1),
-		Updates:  make([]*Update, 0),
-		Lock:     new(sync.RWMutex),
-		LastPing: time.Now(),
+		Conn:       c,
+		Server:     server,
+		ID:         id,
+		MsgQ:       make(chan *Msg, 1),
+		Updates:    make([]*Update, 0),
+		Lock:       new(sync.RWMutex),
+		Caps:       make(map[string]bool),
+		Channels:   make(map[*Channel]bool),
+		Stats:      new(ConnStats),
+		Connected:  time.Now(),
+		LastPing:   time.Now(),
+		LastActive: time.Now(),
 		ClientInfo: ClientInfo{
 			Mode:     &Mode{""},
 			Nick:     "",
-			GlobalOp: true,
+			GlobalOp: false,
 		},
 	}
 
-	// Set our timeout pretty high
-	cli.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 1))
-
-	// Change the state depending on if we need a password or nick
-	if server.HasPassword() {
-		cli.State = STATE_WAIT_PW
-	} else {
-		cli.State = STATE_WAIT_NICK
-	}
+	cli.State = STATE_REGISTERING
 
 	// Write empty line for lulz
 	cli.Write("")
@@ -93,7 +151,7 @@ func NewClient(id int, server *Server, c net.Conn) *Client {
 
 // Gets the user hash
 func (c *Client) GetHash() string {
-	return fmt.Sprintf("%s!%s@%s", c.Nick, c.User, c.GetAddr())
+	return fmt.Sprintf("%s!%s@%s", c.Nick, c.User, c.GetHost())
 }
 
 // Grabs a write lock and changes the state
@@ -108,6 +166,66 @@ func (c *Client) GetAddr() string {
 	return strings.Split(c.Conn.RemoteAddr().String(), ":")[0]
 }
 
+// Returns the host the client is shown with
+func (c *Client) GetHost() string {
+	if c.Host != "" {
+		return c.Host
+	}
+	return c.GetAddr()
+}
+
+// Returns a snapshot of the channels the client is on
+func (c *Client) ChannelList() []*Channel {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	channels := make([]*Channel, 0, len(c.Channels))
+	for v := range c.Channels {
+		channels = append(channels, v)
+	}
+	return channels
+}
+
+// Returns the number of channels the client is on
+func (c *Client) ChannelCount() int {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	return len(c.Channels)
+}
+
+// Marks the client as being on channel `ch`, see Channel.AddMember
+func (c *Client) AddChannel(ch *Channel) {
+	c.Lock.Lock()
+	c.Channels[ch] = true
+	c.Lock.Unlock()
+}
+
+// Marks the client as no longer being on channel `ch`, see Channel.RmvMember
+func (c *Client) RmvChannel(ch *Channel) {
+	c.Lock.Lock()
+	delete(c.Channels, ch)
+	c.Lock.Unlock()
+}
+
+// Returns true if the client has enabled capability `name`
+func (c *Client) HasCap(name string) bool {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	return c.Caps[name]
+}
+
+// Returns true if the client is connected over TLS
+func (c *Client) IsSecure() bool {
+	_, ok := c.Conn.(*tls.Conn)
+	return ok
+}
+
+// Resets the idle time
+func (c *Client) MarkActive() {
+	c.Lock.Lock()
+	c.LastActive = time.Now()
+	c.Lock.Unlock()
+}
+
 // Grabs a read lock and checks whether we have timed out
 func (c *Client) CheckPing() bool {
 	c.Lock.RLock()
@@ -118,11 +236,39 @@ func (c *Client) CheckPing() bool {
 	return true
 }
 
-// Creates a new response towards the client
+// Disconnects the client if it sent more than MESSAGES_PER_5_SEC messages
+// since the last check, and starts counting again
+func (c *Client) CheckRateLimit() {
+	c.Lock.Lock()
+	messages := c.Messages
+	c.Messages = 0
+	c.Lock.Unlock()
+
+	if messages > MESSAGES_PER_5_SEC {
+		c.LogF("Client %s seems to be spamming... kicking!", c.Nick)
+		c.Fail("", "RATE_LIMITED").Send("You are sending messages too fast")
+		c.ForceDC("Rate Limiting")
+	}
+}
+
+// Creates a new numeric response towards the client
 func (c *Client) Resp(tag string) *Response {
-	r := NewResponse(tag, c, c.Server)
-	r.Server = c.Server
-	return r
+	return NewResponse(tag, c, c.Server)
+}
+
+// Creates a new server-sourced command towards the client
+func (c *Client) ServerCmd(tag string) *Response {
+	return NewServerCommand(tag, c, c.Server)
+}
+
+// Creates a new command originating from the client
+func (c *Client) Cmd(tag string) *Response {
+	return NewCommand(tag, c)
+}
+
+// Creates a new server notice towards the client
+func (c *Client) Notice(text string) *Response {
+	return NewNotice(c, c.Server, text)
 }
 
 // Resets our ping
@@ -134,24 +280,433 @@ func (c *Client) MarkPing() {
 
 // Called after the AUTH process is done
 func (c *Client) Init() {
-	c.Resp(RPL_WELCOME).SetF("Welcome to %s %s! %s@%s", c.Server.Name, c.Nick, c.User, c.GetAddr()).Send()
-	c.Resp(RPL_MYINFO).Set(c.Server.Name).Send()
+	c.Signon = time.Now()
+	c.Resp(RPL_WELCOME).SetF(":Welcome to %s %s! %s@%s", c.Server.Name, c.Nick, c.User, c.GetHost()).Send()
+	c.Resp(RPL_YOURHOST).SetF(":Your host is %s, running version %s", c.Server.GetHash(), c.Server.GetVersion()).Send()
+	c.Resp(RPL_CREATED).SetF(":This server was created %s", c.Server.Created.UTC().Format(time.RFC1123)).Send()
+	c.Resp(RPL_MYINFO).Set(c.Server.GetHash()).Set(c.Server.GetVersion()).Set(USER_MODES).Set(CHAN_MODES).Send()
+	c.SendISupport()
+	c.SendLusers()
 	c.SendMOTD()
 }
 
+// Finishes registration once both NICK and USER were received, and no CAP
+// negotiation is holding it up. Checks the server password, if there is one
+func (c *Client) TryRegister() {
+	if c.State != STATE_REGISTERING || c.Nick == "" || c.User == "" || c.CapHold {
+		return
+	}
+
+	pass := subtle.ConstantTimeCompare([]byte(c.Pass), []byte(c.Server.Password)) == 1
+	if c.Server.HasPassword() && !pass {
+		c.Log("Client sent the wrong server password")
+		c.Resp(ERR_PASSWDMISMATCH).Set(":Password incorrect").Send()
+		c.ForceDC("Bad Password")
+		return
+	}
+
+	if ban := c.Server.FindBan(c); ban != nil {
+		c.LogF("Client matches K-line %s\n", ban.Mask)
+		c.Resp(ERR_YOUREBANNEDCREEP).SetF(":You are banned from this server (%s)", ban.Reason).Send()
+		c.ForceDC("K-lined")
+		return
+	}
+
+	// The user is authed up and ready to go
+	c.SetState(STATE_ACTIVE)
+	c.Server.CountUsers()
+	c.Init()
+}
+
+// Sends the LUSERS replies
+func (c *Client) SendLusers() {
+	var users, invisible, opers, unknown int = 0, 0, 0, 0
+	for _, v := range c.Server.ClientList() {
+		if v.State != STATE_ACTIVE {
+			unknown += 1
+			continue
+		}
+		if v.Mode.HasMode(USER_MODE_INVISIBLE) {
+			invisible += 1
+		} else {
+			users += 1
+		}
+		if v.GlobalOp {
+			opers += 1
+		}
+	}
+
+	c.Resp(RPL_LUSERCLIENT).SetF(":There are %d users and %d invisible on 1 servers", users, invisible).Send()
+	c.Resp(RPL_LUSEROP).Set(opers).Set(":operator(s) online").Send()
+	c.Resp(RPL_LUSERUNKNOWN).Set(unknown).Set(":unknown connection(s)").Send()
+	c.Resp(RPL_LUSERCHANNELS).Set(len(c.Server.Channels)).Set(":channels formed").Send()
+	c.Resp(RPL_LUSERME).SetF(":I have %d clients and 0 servers", users+invisible).Send()
+
+	// We are the only server, so local and global counts are the same
+	current, max := c.Server.CountUsers(), c.Server.MaxUsers
+	c.Resp(RPL_LOCALUSERS).Set(current).Set(max).SetF(":Current local users %d, max %d", current, max).Send()
+	c.Resp(RPL_GLOBALUSERS).Set(current).Set(max).SetF(":Current global users %d, max %d", current, max).Send()
+}
+
+// Sends the VERSION reply (followed by ISUPPORT, like on registration)
+func (c *Client) SendVersion() {
+	c.Resp(RPL_VERSION).Set(c.Server.GetVersion()).Set(c.Server.GetHash()).SetF(":%s (commit %s)", c.Server.Name, c.Server.Commit).Send()
+	c.SendISupport()
+}
+
+// Sends the INFO reply
+func (c *Client) SendInfo() {
+	info := []string{
+		fmt.Sprintf("%s (the Go IRC Daemon) running on %s", c.Server.Name, c.Server.GetHash()),
+		fmt.Sprintf("Version %s, commit %s", c.Server.GetVersion(), c.Server.Commit),
+		fmt.Sprintf("Birth Date: %s", c.Server.Created.UTC().Format(time.RFC1123)),
+		fmt.Sprintf("On-line since %s", c.Server.StartTime.UTC().Format(time.RFC1123)),
+		fmt.Sprintf("Uptime %s", time.Now().Sub(c.Server.StartTime).Truncate(time.Second)),
+	}
+	for _, v := range info {
+		c.Resp(RPL_INFO).SetF(":%s", v).Send()
+	}
+	c.Resp(RPL_ENDOFINFO).Set(":End of /INFO list.").Send()
+}
+
+// Sends the ADMIN reply
+func (c *Client) SendAdmin() {
+	s := c.Server
+	if s.AdminLoc1 == "" && s.AdminLoc2 == "" && s.AdminEmail == "" {
+		c.Resp(ERR_NOADMININFO).Set(s.GetHash()).Set(":No administrative info available").Send()
+		return
+	}
+
+	c.Resp(RPL_ADMINME).Set(s.GetHash()).Set(":Administrative info").Send()
+	c.Resp(RPL_ADMINLOC1).SetF(":%s", s.AdminLoc1).Send()
+	c.Resp(RPL_ADMINLOC2).SetF(":%s", s.AdminLoc2).Send()
+	c.Resp(RPL_ADMINEMAIL).SetF(":%s", s.AdminEmail).Send()
+}
+
+// Sends the servers ISUPPORT tokens
+func (c *Client) SendISupport() {
+	// Everything around the tokens has to fit in the line too
+	trail := ":are supported by this server"
+	size := MAX_LINE_SIZE - len(c.Resp(RPL_ISUPPORT).Set(trail).Build()) - 1
+
+	for _, line := range c.Server.ISupport.Lines(size) {
+		c.Resp(RPL_ISUPPORT).Set(line).Set(trail).Send()
+	}
+}
+
 // Send MOTD
 func (c *Client) SendMOTD() {
-	c.Resp(RPL_MOTDSTART).Set(":- MESSAGE OF THE DAY -")
+	if len(c.Server.MOTD) == 0 {
+		c.Resp(ERR_NOMOTD).Set(":MOTD File is missing").Send()
+		return
+	}
+
+	c.Resp(RPL_MOTDSTART).SetF(":- %s Message of the day - ", c.Server.GetHash()).Send()
 	for _, v := range c.Server.MOTD {
-		c.Resp(RPL_MOTD).SetF(":%s", v).Send()
+		c.Resp(RPL_MOTD).SetF(":- %s", v).Send()
+	}
+	c.Resp(RPL_ENDOFMOTD).Set(":End of /MOTD command.").Send()
+}
+
+// Sends the WHOIS replies for client `cl` (everything but RPL_ENDOFWHOIS)
+func (c *Client) SendWhois(cl *Client) {
+	c.Resp(RPL_WHOISUSER).Set(cl.Nick).Set(cl.User).Set(cl.GetHost()).Set("*").SetF(":%s", cl.RealName).Send()
+
+	// Secret channels are only shown to people who are on them too. Everything
+	//  in front of the channel list has to fit in the line too
+	size := MAX_LINE_SIZE - len(c.Resp(RPL_WHOISCHANNELS).Set(cl.Nick).Set(":").Build())
+	var base string = ""
+	for _, v := range cl.ChannelList() {
+		if v.Mode.HasMode(CHAN_MODE_SECRET) && !v.IsMember(c) {
+			continue
+		}
+		name := v.MemberPrefixFor(cl, c) + v.GetName()
+		if base != "" && len(base)+1+len(name) > size {
+			c.Resp(RPL_WHOISCHANNELS).Set(cl.Nick).SetF(":%s", base).Send()
+			base = ""
+		}
+		if base != "" {
+			base += " "
+		}
+		base += name
+	}
+	if base != "" {
+		c.Resp(RPL_WHOISCHANNELS).Set(cl.Nick).SetF(":%s", base).Send()
+	}
+
+	c.Resp(RPL_WHOISSERVER).Set(cl.Nick).Set(c.Server.GetHash()).SetF(":%s", c.Server.Name).Send()
+	if cl.Away != "" {
+		c.Resp(RPL_AWAY).Set(cl.Nick).SetF(":%s", cl.Away).Send()
+	}
+	if cl.GlobalOp {
+		c.Resp(RPL_WHOISOPERATOR).Set(cl.Nick).Set(":is an IRC operator").Send()
+	}
+	if cl.Account != "" {
+		c.Resp(RPL_WHOISACCOUNT).Set(cl.Nick).Set(cl.Account).Set(":is logged in as").Send()
+	}
+	if cl.IsSecure() {
+		c.Resp(RPL_WHOISSECURE).Set(cl.Nick).Set(":is using a secure connection").Send()
+	}
+
+	cl.Lock.RLock()
+	idle := int(time.Now().Sub(cl.LastActive).Seconds())
+	cl.Lock.RUnlock()
+	c.Resp(RPL_WHOISIDLE).Set(cl.Nick).Set(idle).Set(cl.Signon.Unix()).Set(":seconds idle, signon time").Send()
+}
+
+// Returns true if the client shares at least one channel with `cl`
+func (c *Client) SharesChannel(cl *Client) bool {
+	for _, v := range c.ChannelList() {
+		if v.IsMember(cl) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every other client sharing at least one channel with the client
+func (c *Client) Peers() []*Client {
+	seen := make(map[*Client]bool)
+	peers := make([]*Client, 0)
+	for _, v := range c.ChannelList() {
+		for _, cl := range v.MemberList() {
+			if cl != c && !seen[cl] {
+				seen[cl] = true
+				peers = append(peers, cl)
+			}
+		}
+	}
+	return peers
+}
+
+// Sets (or clears, if `msg` is empty) the away message, and lets peers that
+// enabled away-notify know
+func (c *Client) SetAway(msg string) {
+	c.Away = msg
+
+	r := c.Cmd(CLIENT_AWAY)
+	if msg != "" {
+		r.SetF(":%s", msg)
+	}
+	r.RequireCap(CAP_AWAY_NOTIFY).SendAll(c.Peers())
+}
+
+// Changes the realname of the client, which it and its peers learn about if
+// they have setname
+func (c *Client) SetName(name string) {
+	c.RealName = name
+
+	r := c.Cmd(CLIENT_SETNAME).SetF(":%s", name).RequireCap(CAP_SETNAME)
+	r.SendTo(c)
+	r.SendAll(c.Peers())
+}
+
+// Changes the user and host the client is shown with (e.g. for cloaks, vhosts
+// or services). An empty user keeps the current one, and an empty host shows
+// the address the client connected from again. Peers with chghost get a
+// CHGHOST, everyone else sees the client quit and rejoin its channels
+func (c *Client) ChangeHost(user string, host string) {
+	if user == "" {
+		user = c.User
+	}
+	shown := host
+	if shown == "" {
+		shown = c.GetAddr()
+	}
+	if user == c.User && shown == c.GetHost() {
+		return
+	}
+
+	// Both of these carry the old hostmask
+	chghost := c.Cmd(CLIENT_CHGHOST).Set(user).Set(shown)
+	quit := c.Cmd(CLIENT_QUIT).Set(":Changing host").Variant(CAP_CHGHOST, chghost)
+
+	c.User = user
+	c.Host = host
+
+	quit.SendAll(c.Peers())
+	chghost.RequireCap(CAP_CHGHOST).SendTo(c)
+	if c.State == STATE_ACTIVE {
+		c.Resp(RPL_VISIBLEHOST).Set(shown).Set(":is now your displayed host").Send()
+	}
+
+	// Replay the joins (and user levels) for everyone that saw the QUIT
+	var away *Response
+	if c.Away != "" {
+		away = c.Cmd(CLIENT_AWAY).SetF(":%s", c.Away).RequireCap(CAP_AWAY_NOTIFY)
+	}
+	for _, ch := range c.ChannelList() {
+		join := NewFanout(ch.JoinCmd(c))
+		mode := ch.MemberModeCmd(c)
+		for _, v := range ch.MemberList() {
+			if v == c || v.HasCap(CAP_CHGHOST) {
+				continue
+			}
+
+			join.SendTo(v)
+			if mode != nil {
+				mode.SendTo(v)
+			}
+			if away != nil {
+				away.SendTo(v)
+			}
+		}
+	}
+}
+
+// Returns true if `cl` may show up in listings (e.g. WHO) the client asks
+// for, invisible users are only listed to people sharing a channel with them
+func (c *Client) CanSee(cl *Client) bool {
+	if c == cl || c.GlobalOp || !cl.Mode.HasMode(USER_MODE_INVISIBLE) {
+		return true
+	}
+	return c.SharesChannel(cl)
+}
+
+// Returns the WHO flags for client `cl`, including its prefix on `ch` if set
+func (c *Client) WhoFlags(cl *Client, ch *Channel) string {
+	flags := "H"
+	if cl.Away != "" {
+		flags = "G"
+	}
+	if cl.GlobalOp {
+		flags += "*"
+	}
+	if ch != nil {
+		flags += ch.MemberPrefixFor(cl, c)
+	}
+	return flags
+}
+
+// Sends a WHO reply for client `cl` as seen on `ch` (which may be nil). If
+// `fields` is set this is a WHOX request, and only those fields are sent
+func (c *Client) SendWhoReply(cl *Client, ch *Channel, fields string, token string) {
+	chname := "*"
+	if ch != nil {
+		chname = ch.GetName()
+	}
+
+	if fields == "" {
+		c.Resp(RPL_WHOREPLY).Set(chname).Set(cl.User).Set(cl.GetHost()).Set(c.Server.GetHash()).
+			Set(cl.Nick).Set(c.WhoFlags(cl, ch)).SetF(":0 %s", cl.RealName).Send()
+		return
+	}
+
+	r := c.Resp(RPL_WHOSPCRPL)
+	for _, f := range WHOX_FIELDS {
+		if !strings.ContainsRune(fields, f) {
+			continue
+		}
+
+		switch f {
+		case 't':
+			if token == "" {
+				token = "0"
+			}
+			r.Set(token)
+		case 'c':
+			r.Set(chname)
+		case 'u':
+			r.Set(cl.User)
+		case 'i':
+			// The real address is only shown to opers and the client itself,
+			//  it would give away a cloaked host
+			if c == cl || c.GlobalOp {
+				r.Set(cl.GetAddr())
+			} else {
+				r.Set("255.255.255.255")
+			}
+		case 'h':
+			r.Set(cl.GetHost())
+		case 's':
+			r.Set(c.Server.GetHash())
+		case 'n':
+			r.Set(cl.Nick)
+		case 'f':
+			r.Set(c.WhoFlags(cl, ch))
+		case 'd':
+			r.Set(0)
+		case 'l':
+			cl.Lock.RLock()
+			r.Set(int(time.Now().Sub(cl.LastActive).Seconds()))
+			cl.Lock.RUnlock()
+		case 'a':
+			if cl.Account == "" {
+				r.Set(0)
+			} else {
+				r.Set(cl.Account)
+			}
+		case 'o':
+			r.Set("n/a")
+		case 'r':
+			r.SetF(":%s", cl.RealName)
+		}
+	}
+	r.Send()
+}
+
+// Splits data read off the connection into lines and queues them up for
+// parsing, a partial line is kept until the rest of it arrives
+func (c *Client) Feed(data []byte) {
+	c.RecvBuf += string(data)
+	for {
+		idx := strings.IndexByte(c.RecvBuf, '\n')
+		if idx == -1 {
+			break
+		}
+		line := strings.TrimSuffix(c.RecvBuf[:idx], "\r")
+		c.RecvBuf = c.RecvBuf[idx+1:]
+
+		// Tags have a limit of their own, on top of the line limit
+		body := line
+		if strings.HasPrefix(line, "@") {
+			tags, rest := splitWord(line[1:])
+			if len(tags) > MAX_TAGS_SIZE {
+				// This runs on the read loop, so is written right away
+				//  rather than caught up in a labeled response being built
+				//  by the parse loop
+				c.Write(c.Resp(ERR_INPUTTOOLONG).Set(":Input line was too long").BuildFor(c))
+				continue
+			}
+			body = rest
+		}
+
+		if len(body) > MAX_LINE_SIZE {
+			c.Log("WARNING: Line size above MAX_LINE_SIZE, skipping...")
+			c.ForceDC("Line size over maximum")
+			return
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		msg := NewMsgFrom(line)
+		if msg == nil {
+			continue
+		}
+		c.Messages += 1
+		atomic.AddInt64(&c.Stats.RecvQ, int64(msg.Size))
+		c.MsgQ <- msg
+		c.LogF("Added msg to buffer!\n")
+	}
+
+	// A partial line that is already too long won't get any shorter
+	if len(c.RecvBuf) > MAX_TAGS_SIZE+MAX_LINE_SIZE+2 {
+		c.ForceDC("Line size over maximum")
 	}
-	c.Resp(RPL_ENDOFMOTD).Set(":End of /MOTD command.")
 }
 
 // Writes a string + LINE_TERM
 func (c *Client) Write(l string) {
 	l = l + LINE_TERM
-	c.Conn.Write([]byte(l))
+	size := int64(len(l))
+
+	atomic.AddInt64(&c.Stats.SendQ, size)
+	n, _ := c.Conn.Write([]byte(l))
+	atomic.AddInt64(&c.Stats.SendQ, -size)
+
+	atomic.AddInt64(&c.Stats.SentMsgs, 1)
+	atomic.AddInt64(&c.Stats.SentBytes, int64(n))
 }
 
 // Formats and writes a string
@@ -161,17 +716,27 @@ func (c *Client) WriteF(l string, vars ...interface{}) {
 
 // Forces a user to disconnect from the server (e.g. kick)
 func (c *Client) ForceDC(s string) {
-	// Part all channels
-	for _, v := range c.Server.Channels {
-		c.LogF("checking chan %s", v.GetName())
-		if v.IsMember(c) {
-			c.Log("yes!")
-			v.ClientPart(c, s)
-		}
+	// Only ever disconnect once
+	if c.State == STATE_DEAD {
+		return
+	}
+
+	// Registered users are remembered for WHOWAS
+	if c.State == STATE_ACTIVE {
+		c.Server.WhoWas.Add(c)
+	}
+
+	// Everyone sharing a channel sees a single QUIT
+	c.Cmd(CLIENT_QUIT).SetF(":%s", s).SendAll(c.Peers())
+
+	// Leave all channels without sending PARTs
+	for _, v := range c.ChannelList() {
+		v.RmvMember(c)
 	}
 
 	c.SetState(STATE_DEAD)
-	c.WriteF("QUIT :%s", s)
+	c.ServerCmd(CLIENT_ERROR).SetF(":Closing Link: %s (%s)", c.GetAddr(), s).Send()
+	c.FlushLabel()
 	c.Conn.Close()
 	c.Server.RmvClient(c.ID)
 }
@@ -0,0 +1,307 @@
+package gircd
+
+import "fmt"
+import "strings"
+import "testing"
+
+func TestWhoxAddress(t *testing.T) {
+	s := newTestServer()
+	alice, aliceConn := newTestClient(s, "alice")
+	bob, bobConn := newTestClient(s, "bob")
+	oper, operConn := newTestClient(s, "oper")
+	alice.Host = "cloak.test"
+	oper.GlobalOp = true
+
+	tests := []struct {
+		Client *Client
+		Conn   *testConn
+		Want   string
+	}{
+		{alice, aliceConn, " 354 alice 10.0.0.1 cloak.test alice"},
+		{bob, bobConn, " 354 bob 255.255.255.255 cloak.test alice"},
+		{oper, operConn, " 354 oper 10.0.0.1 cloak.test alice"},
+	}
+
+	for _, v := range tests {
+		testSend(v.Client, "WHO alice %nih")
+		if got := v.Conn.Lines(); !hasLine(got, v.Want) {
+			t.Errorf("%s: got %q, want %q", v.Client.Nick, got, v.Want)
+		}
+	}
+}
+
+func TestChangeHost(t *testing.T) {
+	s := newTestServer()
+	alice, aliceConn := newTestClient(s, "alice")
+	bob, bobConn := newTestClient(s, "bob", CAP_CHGHOST)
+	carol, carolConn := newTestClient(s, "carol")
+	newTestChannel(s, "#x", alice, bob, carol)
+
+	alice.ChangeHost("", "cloak.test")
+
+	tests := []struct {
+		Name string
+		Conn *testConn
+		Want []string
+	}{
+		{"chghost peer", bobConn, []string{
+			":alice!alice@10.0.0.1 CHGHOST alice cloak.test",
+		}},
+		{"other peer", carolConn, []string{
+			":alice!alice@10.0.0.1 QUIT :Changing host",
+			":alice!alice@cloak.test JOIN #x",
+			":irc.test MODE #x +o alice",
+		}},
+		{"self", aliceConn, []string{
+			":irc.test 396 alice cloak.test :is now your displayed host",
+		}},
+	}
+
+	for _, v := range tests {
+		got := v.Conn.Lines()
+		if len(got) != len(v.Want) {
+			t.Errorf("%s: got %q, want %q", v.Name, got, v.Want)
+			continue
+		}
+		for idx := range got {
+			if got[idx] != v.Want[idx] {
+				t.Errorf("%s: got %q, want %q", v.Name, got[idx], v.Want[idx])
+			}
+		}
+	}
+
+	if host := alice.GetHost(); host != "cloak.test" {
+		t.Errorf("host is %q, want cloak.test", host)
+	}
+
+	// Nothing changes, nothing is sent
+	alice.ChangeHost("", "cloak.test")
+	if got := carolConn.Lines(); len(got) != 0 {
+		t.Errorf("unchanged host sent %q", got)
+	}
+}
+
+func TestWhois(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	bob, conn := newTestClient(s, "bob")
+	newTestChannel(s, "#pub", alice)
+	secret := newTestChannel(s, "#sec", alice)
+	secret.Mode.AddMode(CHAN_MODE_SECRET)
+	alice.Away = "lunch"
+
+	tests := []struct {
+		Name    string
+		Line    string
+		Want    []string
+		NotWant []string
+	}{
+		{"outsider", "WHOIS alice", []string{
+			":irc.test 311 bob alice alice 10.0.0.1 * :Real alice",
+			":irc.test 319 bob alice :@#pub",
+			" 312 bob alice irc.test ",
+			":irc.test 301 bob alice :lunch",
+			":irc.test 318 bob alice :End of /WHOIS list.",
+		}, []string{"#sec"}},
+		{"unknown nick", "WHOIS nobody", []string{
+			" 401 bob nobody ",
+			" 318 bob nobody ",
+		}, []string{" 311 "}},
+	}
+
+	for _, v := range tests {
+		testSend(bob, v.Line)
+		got := conn.Lines()
+		for _, want := range v.Want {
+			if !hasLine(got, want) {
+				t.Errorf("%s: got %q, want %q", v.Name, got, want)
+			}
+		}
+		for _, bad := range v.NotWant {
+			if hasLine(got, bad) {
+				t.Errorf("%s: got %q, which should not have %q", v.Name, got, bad)
+			}
+		}
+	}
+
+	// Members of a secret channel see it
+	secret.AddMember(bob)
+	testSend(bob, "WHOIS alice")
+	if got := conn.Lines(); !hasLine(got, "#sec") {
+		t.Errorf("member of the secret channel: got %q", got)
+	}
+}
+
+func TestWhoisChannelsLineSize(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+	bob, _ := newTestClient(s, "bob")
+
+	want := make(map[string]bool)
+	for idx := 0; idx < 60; idx++ {
+		name := fmt.Sprintf("#%s%02d", strings.Repeat("x", 40), idx)
+		newTestChannel(s, name, bob, alice)
+		want[name] = true
+	}
+
+	alice.SendWhois(bob)
+	for _, line := range conn.Lines() {
+		if !strings.Contains(line, " 319 ") {
+			continue
+		}
+		if len(line) > MAX_LINE_SIZE {
+			t.Errorf("%d byte line: %q", len(line), line)
+		}
+		for _, name := range strings.Fields(line[strings.Index(line[1:], ":")+2:]) {
+			delete(want, strings.TrimPrefix(name, "@"))
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("%d channels missing from WHOIS", len(want))
+	}
+}
+
+func TestAway(t *testing.T) {
+	s := newTestServer()
+	alice, aliceConn := newTestClient(s, "alice")
+	bob, bobConn := newTestClient(s, "bob", CAP_AWAY_NOTIFY)
+	carol, carolConn := newTestClient(s, "carol")
+	newTestChannel(s, "#x", alice, bob, carol)
+
+	tests := []struct {
+		Line string
+		Self string
+		Peer string
+	}{
+		{"AWAY :lunch", ":irc.test 306 alice :You have been marked as being away",
+			":alice!alice@10.0.0.1 AWAY :lunch"},
+		{"AWAY", ":irc.test 305 alice :You are no longer marked as being away",
+			":alice!alice@10.0.0.1 AWAY"},
+	}
+
+	for _, v := range tests {
+		testSend(alice, v.Line)
+		if got := aliceConn.Lines(); len(got) != 1 || got[0] != v.Self {
+			t.Errorf("%q: got %q, want %q", v.Line, got, v.Self)
+		}
+		if got := bobConn.Lines(); len(got) != 1 || got[0] != v.Peer {
+			t.Errorf("%q: away-notify peer got %q, want %q", v.Line, got, v.Peer)
+		}
+		if got := carolConn.Lines(); len(got) != 0 {
+			t.Errorf("%q: peer without away-notify got %q", v.Line, got)
+		}
+	}
+
+	// Messaging someone away tells the sender
+	testSend(alice, "AWAY :lunch")
+	aliceConn.Lines()
+	testSend(carol, "PRIVMSG alice :hi")
+	if got := carolConn.Lines(); !hasLine(got, ":irc.test 301 carol alice :lunch") {
+		t.Errorf("PRIVMSG to away user: got %q, want RPL_AWAY", got)
+	}
+	testSend(carol, "NOTICE alice :hi")
+	if got := carolConn.Lines(); len(got) != 0 {
+		t.Errorf("NOTICE to away user: got %q, want nothing", got)
+	}
+
+	// Away-notify peers learn whether someone joining is away. The JOIN
+	//  itself comes from the channel's goroutine
+	dave, _ := newTestClient(s, "dave")
+	testSend(dave, "AWAY :gone")
+	testSend(dave, "JOIN #x")
+	if got := bobConn.Lines(); !hasLine(got, ":dave!dave@10.0.0.1 AWAY :gone") {
+		t.Errorf("away user joining: got %q, want AWAY", got)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	tests := []struct {
+		Line   string
+		Reason string
+	}{
+		{"QUIT :bye", "Quit: bye"},
+		{"QUIT", "Client Quit"},
+		{"QUIT :", "Client Quit"},
+	}
+
+	for _, v := range tests {
+		s := newTestServer()
+		alice, aliceConn := newTestClient(s, "alice")
+		bob, bobConn := newTestClient(s, "bob")
+		newTestChannel(s, "#x", alice, bob)
+		newTestChannel(s, "#y", alice, bob)
+
+		testSend(alice, v.Line)
+
+		// A single QUIT for peers, however many channels they share
+		want := ":alice!alice@10.0.0.1 QUIT :" + v.Reason
+		if got := bobConn.Lines(); len(got) != 1 || got[0] != want {
+			t.Errorf("%q: peer got %q, want %q", v.Line, got, want)
+		}
+		want = ":irc.test ERROR :Closing Link: 10.0.0.1 (" + v.Reason + ")"
+		if got := aliceConn.Lines(); len(got) != 1 || got[0] != want {
+			t.Errorf("%q: got %q, want %q", v.Line, got, want)
+		}
+		if s.HasClient(alice.ID) || s.FindUserByNick("alice") != nil {
+			t.Errorf("%q: client was not removed", v.Line)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Password string
+		Lines    []string
+
+		// Lines expected after all but the last line, and after the last
+		Before []string
+		After  []string
+	}{
+		{"NICK then USER", "", []string{"NICK alice", "USER alice 0 * :Alice"},
+			nil, []string{":irc.test 001 alice "}},
+		{"USER then NICK", "", []string{"USER alice 0 * :Alice", "NICK alice"},
+			nil, []string{":irc.test 001 alice "}},
+		{"CAP holds registration", "", []string{"CAP LS 302", "NICK alice", "USER alice 0 * :Alice", "CAP END"},
+			[]string{" CAP * LS "}, []string{":irc.test 001 alice "}},
+		{"right password", "secret", []string{"PASS secret", "NICK alice", "USER alice 0 * :Alice"},
+			nil, []string{":irc.test 001 alice "}},
+		{"wrong password", "secret", []string{"PASS wrong", "NICK alice", "USER alice 0 * :Alice"},
+			nil, []string{":irc.test 464 alice :Password incorrect", "ERROR :Closing Link: 10.0.0.2 (Bad Password)"}},
+		{"no password", "secret", []string{"NICK alice", "USER alice 0 * :Alice"},
+			nil, []string{" 464 alice "}},
+	}
+
+	for _, v := range tests {
+		s := newTestServer()
+		s.Password = v.Password
+		cl, conn := newUnregisteredClient(s)
+
+		last := len(v.Lines) - 1
+		for _, line := range v.Lines[:last] {
+			testSend(cl, line)
+		}
+		got := conn.Lines()
+		for _, want := range v.Before {
+			if !hasLine(got, want) {
+				t.Errorf("%s: got %q, want %q", v.Name, got, want)
+			}
+		}
+		if hasLine(got, " 001 ") || cl.State != STATE_REGISTERING {
+			t.Errorf("%s: registered before %q", v.Name, v.Lines[last])
+		}
+
+		testSend(cl, v.Lines[last])
+		got = conn.Lines()
+		for _, want := range v.After {
+			if !hasLine(got, want) {
+				t.Errorf("%s: got %q, want %q", v.Name, got, want)
+			}
+		}
+
+		registered := hasLine(got, " 001 ")
+		if registered != (cl.State == STATE_ACTIVE) || (!registered && s.HasClient(cl.ID)) {
+			t.Errorf("%s: registered %v, in state %d", v.Name, registered, cl.State)
+		}
+	}
+}
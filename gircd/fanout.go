@@ -0,0 +1,95 @@
+package gircd
+
+// Renders a response for many recipients (e.g. a channel), building each
+// distinct form of it only once. A form is the variant a recipient gets,
+// along with the tags it negotiated
+type Fanout struct {
+	Response *Response
+
+	// Sorted tag names of the base response (0) and each variant (1...)
+	tags map[int][]string
+
+	// Rendered lines by form, see key
+	lines map[uint64]string
+}
+
+func NewFanout(r *Response) *Fanout {
+	return &Fanout{
+		Response: r,
+		tags:     make(map[int][]string),
+		lines:    make(map[uint64]string),
+	}
+}
+
+// Returns the variant client `cl` gets, and its index (0 is the response
+// itself)
+func (f *Fanout) variant(cl *Client) (*Response, int) {
+	for idx, v := range f.Response.Variants {
+		if cl.HasCap(v.Cap) {
+			return v.Response, idx + 1
+		}
+	}
+	return f.Response, 0
+}
+
+// Returns the key for the form client `cl` gets of variant `idx`, which has
+// one bit per tag. Responses with too many tags to fit are never cached
+func (f *Fanout) key(cl *Client, r *Response, idx int) (uint64, bool) {
+	names, has := f.tags[idx]
+	if !has {
+		names = make([]string, 0, len(r.Tags))
+		for k := range r.Tags {
+			names = append(names, k)
+		}
+		f.tags[idx] = names
+	}
+	if len(names) > 32 {
+		return 0, false
+	}
+
+	key := uint64(idx) << 32
+	for bit, name := range names {
+		if cl.WantsTag(name) {
+			key |= 1 << uint(bit)
+		}
+	}
+	return key, true
+}
+
+// Returns the line client `cl` gets, or false if it gets none
+func (f *Fanout) LineFor(cl *Client) (string, bool) {
+	r, idx := f.variant(cl)
+	if r.Cap != "" && !cl.HasCap(r.Cap) {
+		return "", false
+	}
+
+	key, ok := f.key(cl, r, idx)
+	if !ok {
+		return r.BuildFor(cl), true
+	}
+	if line, has := f.lines[key]; has {
+		return line, true
+	}
+
+	line := r.BuildFor(cl)
+	f.lines[key] = line
+	return line, true
+}
+
+// Writes the response to client `cl` right away. This skips labeled
+// responses, a fan-out is never the reply to a single client
+func (f *Fanout) SendTo(cl *Client) {
+	if line, ok := f.LineFor(cl); ok {
+		cl.Write(line)
+	}
+}
+
+// Writes the response to every client in `clients` but r.Exclude
+func (r *Response) SendAll(clients []*Client) {
+	f := NewFanout(r)
+	for _, v := range clients {
+		if v != r.Exclude {
+			f.SendTo(v)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package gircd
+
+import "fmt"
+import "testing"
+
+// Returns a JOIN with an extended-join variant, and client-only tags
+func newFanoutTestJoin(cl *Client, tags int) *Response {
+	r := cl.Cmd(CLIENT_JOIN).Set("#x")
+	r.Tags[TAG_MSGID] = "abc"
+	r.Tags[TAG_TIME] = "2020-01-01T00:00:00.000Z"
+	for idx := 0; idx < tags; idx++ {
+		r.SetTag(fmt.Sprintf("+tag%d", idx), "v")
+	}
+	return r.Variant(CAP_EXTENDED_JOIN, r.Copy().Set("account").Set(":Real Name"))
+}
+
+func TestFanoutMixedCaps(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+
+	// Two members for every mix of capabilities that changes the line
+	caps := []string{CAP_SERVER_TIME, CAP_MESSAGE_TAGS, CAP_EXTENDED_JOIN}
+	members := make([]*Client, 0)
+	for mask := 0; mask < 1<<uint(len(caps)); mask++ {
+		enabled := make([]string, 0)
+		for bit, name := range caps {
+			if mask&(1<<uint(bit)) != 0 {
+				enabled = append(enabled, name)
+			}
+		}
+		for idx := 0; idx < 2; idx++ {
+			cl, _ := newTestClient(s, fmt.Sprintf("m%d_%d", mask, idx), enabled...)
+			members = append(members, cl)
+		}
+	}
+
+	// Few enough tags to be cached by bitmask, and too many to be
+	for _, tags := range []int{1, 40} {
+		r := newFanoutTestJoin(alice, tags)
+		f := NewFanout(r)
+		forms := make(map[string]bool)
+		for _, cl := range members {
+			got, ok := f.LineFor(cl)
+			want := r.For(cl).BuildFor(cl)
+			if !ok || got != want {
+				t.Errorf("%d tags, %s: got %q, want %q", tags, cl.Nick, got, want)
+			}
+			forms[got] = true
+		}
+
+		// Every mix is a different form, as `time` needs server-time and the
+		//  other tags need message-tags
+		if len(forms) != 8 {
+			t.Errorf("%d tags: got %d forms, want 8", tags, len(forms))
+		}
+		if tags <= 32 && len(f.lines) != 8 {
+			t.Errorf("%d tags: cached %d forms, want 8", tags, len(f.lines))
+		}
+		if tags > 32 && len(f.lines) != 0 {
+			t.Errorf("%d tags: cached %d forms past the bitmask", tags, len(f.lines))
+		}
+	}
+}
+
+func TestFanoutRequireCap(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	plain, _ := newTestClient(s, "plain")
+	tagged, _ := newTestClient(s, "tagged", CAP_MESSAGE_TAGS)
+
+	f := NewFanout(alice.Cmd(CLIENT_TAGMSG).Set("#x").RequireCap(CAP_MESSAGE_TAGS))
+	if _, ok := f.LineFor(plain); ok {
+		t.Errorf("client without the capability got a line")
+	}
+	if _, ok := f.LineFor(tagged); !ok {
+		t.Errorf("client with the capability got no line")
+	}
+}
+
+// Members of the channel the fan-out benchmarks send to, with a few
+// different mixes of capabilities
+func newFanoutBenchMembers(s *Server, count int) []*Client {
+	mixes := [][]string{
+		{},
+		{CAP_SERVER_TIME},
+		{CAP_MESSAGE_TAGS, CAP_SERVER_TIME},
+		{CAP_EXTENDED_JOIN, CAP_MESSAGE_TAGS, CAP_SERVER_TIME},
+	}
+	members := make([]*Client, count)
+	for idx := range members {
+		conn := &discardConn{testConn{Addr: "10.0.0.1"}}
+		members[idx] = newTestClientOn(s, conn, fmt.Sprintf("m%d", idx), mixes[idx%len(mixes)]...)
+	}
+	return members
+}
+
+func BenchmarkFanout5k(b *testing.B) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	members := newFanoutBenchMembers(s, 5000)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		newFanoutTestJoin(alice, 1).SendAll(members)
+	}
+}
+
+func BenchmarkPerRecipient5k(b *testing.B) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	members := newFanoutBenchMembers(s, 5000)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r := newFanoutTestJoin(alice, 1)
+		for _, v := range members {
+			v.Write(r.For(v).BuildFor(v))
+		}
+	}
+}
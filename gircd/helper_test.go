@@ -0,0 +1,125 @@
+package gircd
+
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+// Connection that keeps everything written to it, for checking output
+type testConn struct {
+	Addr  string
+	lines []string
+	lock  sync.Mutex
+}
+
+func (c *testConn) Read(b []byte) (int, error)         { return 0, nil }
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) LocalAddr() net.Addr                { return c.RemoteAddr() }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(c.Addr), Port: 6667}
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, v := range strings.Split(strings.TrimSuffix(string(b), LINE_TERM), LINE_TERM) {
+		if v != "" {
+			c.lines = append(c.lines, v)
+		}
+	}
+	return len(b), nil
+}
+
+// Returns (and forgets) the lines written so far
+func (c *testConn) Lines() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := c.lines
+	c.lines = nil
+	return res
+}
+
+// Connection that throws away everything written to it, for benchmarks
+type discardConn struct {
+	testConn
+}
+
+func (c *discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+var testParserOnce sync.Once
+
+func newTestServer() *Server {
+	testParserOnce.Do(InitParser)
+	return NewServer("irc.test", "0", "")
+}
+
+// Creates a client that has only just connected
+func newUnregisteredClient(s *Server) (*Client, *testConn) {
+	conn := &testConn{Addr: "10.0.0.2"}
+	cl := NewClient(s.NextID(), s, conn)
+	s.AddClient(cl)
+	return cl, conn
+}
+
+// Creates a registered client, with the given capabilities enabled
+func newTestClient(s *Server, nick string, caps ...string) (*Client, *testConn) {
+	conn := &testConn{Addr: "10.0.0.1"}
+	return newTestClientOn(s, conn, nick, caps...), conn
+}
+
+// Same as newTestClient, on connection `conn`
+func newTestClientOn(s *Server, conn net.Conn, nick string, caps ...string) *Client {
+	cl := NewClient(s.NextID(), s, conn)
+	cl.User = strings.ToLower(nick)
+	cl.RealName = "Real " + nick
+	for _, v := range caps {
+		cl.Caps[v] = true
+	}
+	s.AddClient(cl)
+	s.SetNick(cl, nick)
+	cl.SetState(STATE_ACTIVE)
+	if tc, ok := conn.(*testConn); ok {
+		tc.Lines()
+	}
+	return cl
+}
+
+// Creates channel `name` with `members` on it, the first of them an op. No
+// JOINs are sent, those would come from the channel's own goroutine
+func newTestChannel(s *Server, name string, members ...*Client) *Channel {
+	ch := s.NewChannel(name[:1], name[1:])
+	for _, v := range members {
+		ch.AddMember(v)
+	}
+	return ch
+}
+
+// Gives the server accounts, `creds` are `name:password` pairs
+func newTestAccounts(s *Server, creds ...string) *MemoryAccounts {
+	accounts := NewMemoryAccounts()
+	for _, v := range creds {
+		pair := strings.SplitN(v, ":", 2)
+		accounts.Add(pair[0], pair[1])
+	}
+	s.Accounts = accounts
+	return accounts
+}
+
+// Sends a line as if it came from the client
+func testSend(cl *Client, line string) {
+	NewMsgFrom(line).Parse(cl)
+}
+
+// Returns true if any of `lines` contains `s`
+func hasLine(lines []string, s string) bool {
+	for _, v := range lines {
+		if strings.Contains(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,534 @@
+package gircd
+
+import "bufio"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// Reasons a CHATHISTORY target is refused, sent as the FAIL description
+var ERR_HISTORY_TARGET = errors.New("Messages could not be retrieved")
+var ERR_HISTORY_ACCOUNT = errors.New("Direct message history is only kept for logged in users")
+
+// Default number of messages kept per channel or DM pair
+const HISTORY_SIZE = 1000
+
+// Most messages a single CHATHISTORY request returns (ISUPPORT CHATHISTORY)
+const HISTORY_MAX_LIMIT = 100
+
+// A message kept in the history
+type HistoryEntry struct {
+	MsgID  string
+	Time   time.Time
+	Prefix string
+	Tag    string
+	Target string
+	Text   string
+
+	// Client-only tags the message was sent with
+	Tags map[string]string
+}
+
+// How much history is kept for a target, zero values mean no limit
+type HistoryRetention struct {
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+// Returns the tail of `entries` (oldest first) that the retention keeps
+func (r HistoryRetention) Apply(entries []*HistoryEntry) []*HistoryEntry {
+	if r.MaxAge > 0 {
+		cutoff := time.Now().Add(-r.MaxAge)
+		idx := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Time.After(cutoff)
+		})
+		entries = entries[idx:]
+	}
+	if r.MaxEntries > 0 && len(entries) > r.MaxEntries {
+		entries = entries[len(entries)-r.MaxEntries:]
+	}
+	return entries
+}
+
+// Stores the history of channels and DM pairs, see HistoryKey and DMKey
+type HistoryStore interface {
+	// Adds an entry under `key`, dropping the ones `retention` doesn't keep
+	Add(key string, e *HistoryEntry, retention HistoryRetention)
+
+	// Returns the entries under `key`, oldest first
+	Get(key string) []*HistoryEntry
+
+	// Returns every key that has history
+	Keys() []string
+
+	// Drops everything under `key`
+	Delete(key string)
+}
+
+// History store that keeps a ring of entries per key in memory
+type MemoryHistory struct {
+	Entries map[string][]*HistoryEntry
+	Lock    *sync.RWMutex
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{
+		Entries: make(map[string][]*HistoryEntry),
+		Lock:    new(sync.RWMutex),
+	}
+}
+
+func (h *MemoryHistory) Add(key string, e *HistoryEntry, retention HistoryRetention) {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+
+	// Copied when trimmed, so the dropped entries can be collected
+	entries := append(h.Entries[key], e)
+	if kept := retention.Apply(entries); len(kept) < len(entries) {
+		entries = append([]*HistoryEntry{}, kept...)
+	}
+	if len(entries) == 0 {
+		delete(h.Entries, key)
+		return
+	}
+	h.Entries[key] = entries
+}
+
+func (h *MemoryHistory) Get(key string) []*HistoryEntry {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	res := make([]*HistoryEntry, len(h.Entries[key]))
+	copy(res, h.Entries[key])
+	return res
+}
+
+func (h *MemoryHistory) Keys() []string {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	res := make([]string, 0, len(h.Entries))
+	for k := range h.Entries {
+		res = append(res, k)
+	}
+	return res
+}
+
+func (h *MemoryHistory) Delete(key string) {
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+	delete(h.Entries, key)
+}
+
+// A line of the history log, lines without an entry drop the key
+type historyLogLine struct {
+	Key   string
+	Entry *HistoryEntry
+}
+
+// History store that keeps entries in memory, and appends every one of them
+// to a log file (one JSON object per line) that is replayed on startup. The
+// replay drops whatever is past its retention, and the log is rewritten with
+// only what is left
+type LogHistory struct {
+	*MemoryHistory
+
+	File *os.File
+	Lock *sync.Mutex
+}
+
+// Opens (or creates) the log at `path`, loading the entries already in it
+// that `retention` (e.g. Server.RetentionFor) still keeps
+func NewLogHistory(path string, retention func(key string) HistoryRetention) (*LogHistory, error) {
+	h := &LogHistory{
+		MemoryHistory: NewMemoryHistory(),
+		Lock:          new(sync.Mutex),
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line historyLogLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if line.Entry == nil {
+			h.MemoryHistory.Delete(line.Key)
+			continue
+		}
+		h.MemoryHistory.Add(line.Key, line.Entry, retention(line.Key))
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := h.compact(path); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Replaces the log at `path` with the entries in memory, and opens it to
+// append to
+func (h *LogHistory) compact(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	keys := h.Keys()
+	sort.Strings(keys)
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		for _, e := range h.Get(key) {
+			data, err := json.Marshal(historyLogLine{key, e})
+			if err != nil {
+				continue
+			}
+			w.Write(append(data, '\n'))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	h.File, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (h *LogHistory) Add(key string, e *HistoryEntry, retention HistoryRetention) {
+	h.MemoryHistory.Add(key, e, retention)
+	h.write(historyLogLine{key, e})
+}
+
+func (h *LogHistory) Delete(key string) {
+	h.MemoryHistory.Delete(key)
+	h.write(historyLogLine{key, nil})
+}
+
+// Appends a line to the log
+func (h *LogHistory) write(line historyLogLine) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	h.Lock.Lock()
+	defer h.Lock.Unlock()
+	h.File.Write(append(data, '\n'))
+}
+
+// Returns the history key for channel `ch`
+func (s *Server) HistoryKey(ch *Channel) string {
+	return s.Fold(ch.GetName())
+}
+
+// Sets how much history channel `name` keeps, instead of HistoryRetention
+func (s *Server) SetChannelRetention(name string, retention HistoryRetention) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.ChannelRetention[s.Fold(name)] = retention
+}
+
+// Returns how much history is kept under `key`, which is HistoryRetention
+// unless it is a channel with a retention of its own
+func (s *Server) RetentionFor(key string) HistoryRetention {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+	if retention, has := s.ChannelRetention[key]; has {
+		return retention
+	}
+	return s.HistoryRetention
+}
+
+// Returns the history key for DMs between accounts `a` and `b`, which is the
+// same both ways. DMs are kept by account rather than nick, so whoever uses a
+// nick next can't read them
+func (s *Server) DMKey(a string, b string) string {
+	a, b = s.Fold(a), s.Fold(b)
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// Creates a history entry from a PRIVMSG or NOTICE
+func NewHistoryEntry(r *Response) *HistoryEntry {
+	e := &HistoryEntry{
+		MsgID:  r.Tags[TAG_MSGID],
+		Time:   time.Now().UTC(),
+		Prefix: r.Prefix,
+		Tag:    r.Tag,
+		Tags:   make(map[string]string),
+	}
+	if t, err := time.Parse(SERVER_TIME_FORMAT, r.Tags[TAG_TIME]); err == nil {
+		e.Time = t
+	}
+	if len(r.Vars) > 0 {
+		e.Target = fmt.Sprint(r.Vars[0])
+		e.Text = strings.TrimPrefix(fmt.Sprint(r.Vars[len(r.Vars)-1]), ":")
+	}
+	for k, v := range r.Tags {
+		if IsClientTag(k) {
+			e.Tags[k] = v
+		}
+	}
+	return e
+}
+
+// Keeps message `r` under `key`, if the server keeps history
+func (s *Server) AddHistory(key string, r *Response) {
+	if s.History == nil {
+		return
+	}
+	s.History.Add(key, NewHistoryEntry(r), s.RetentionFor(key))
+}
+
+// Returns the entries under `key` that are within its retention, entries
+// that aged out since the last message are still in the store
+func (s *Server) GetHistory(key string) []*HistoryEntry {
+	if s.History == nil {
+		return nil
+	}
+	return s.RetentionFor(key).Apply(s.History.Get(key))
+}
+
+// Builds the message an entry was created from
+func (e *HistoryEntry) Response(s *Server) *Response {
+	r := &Response{
+		Tag:    e.Tag,
+		Vars:   make([]interface{}, 0),
+		Source: SOURCE_CLIENT,
+		Server: s,
+		Prefix: e.Prefix,
+		Tags: map[string]string{
+			TAG_MSGID: e.MsgID,
+			TAG_TIME:  e.Time.UTC().Format(SERVER_TIME_FORMAT),
+		},
+	}
+	return r.SetTags(e.Tags).Set(e.Target).SetF(":%s", e.Text)
+}
+
+// Returns the entries before (`lo`) and after (`hi`) a message reference,
+// which is either `msgid=...` or `timestamp=...`. A msgid that isn't in
+// `entries` returns false
+func historyBounds(entries []*HistoryEntry, ref string) (int, int, bool) {
+	kv := strings.SplitN(ref, "=", 2)
+	if len(kv) != 2 {
+		return 0, 0, false
+	}
+
+	switch kv[0] {
+	case "msgid":
+		for idx, e := range entries {
+			if e.MsgID == kv[1] {
+				return idx, idx + 1, true
+			}
+		}
+	case "timestamp":
+		t, err := time.Parse(SERVER_TIME_FORMAT, kv[1])
+		if err != nil {
+			return 0, 0, false
+		}
+		lo := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Time.Before(t)
+		})
+		hi := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Time.After(t)
+		})
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
+
+// Picks the entries a CHATHISTORY subcommand asks for (LATEST, BEFORE,
+// AFTER, AROUND or BETWEEN), `refs` holds its one or two message references
+func SelectHistory(entries []*HistoryEntry, sub string, refs []string, limit int) ([]*HistoryEntry, bool) {
+	n := len(entries)
+	bounds := make([][2]int, len(refs))
+	for idx, ref := range refs {
+		// LATEST takes `*` for no bound at all
+		if ref == "*" && sub == "LATEST" {
+			bounds[idx] = [2]int{n, n}
+			continue
+		}
+
+		lo, hi, ok := historyBounds(entries, ref)
+		if !ok {
+			return nil, false
+		}
+		bounds[idx] = [2]int{lo, hi}
+	}
+
+	var start, end int
+	switch sub {
+	case "LATEST":
+		end = n
+		start = n - limit
+		if refs[0] != "*" && start < bounds[0][1] {
+			start = bounds[0][1]
+		}
+	case "BEFORE":
+		end = bounds[0][0]
+		start = end - limit
+	case "AFTER":
+		start = bounds[0][1]
+		end = start + limit
+	case "AROUND":
+		start = bounds[0][0] - limit/2
+		if start < 0 {
+			start = 0
+		}
+		end = start + limit
+	case "BETWEEN":
+		// Either bound may come first, the limit counts from the first one
+		a, b := bounds[0], bounds[1]
+		if a[1] <= b[0] {
+			start, end = a[1], b[0]
+			if end > start+limit {
+				end = start + limit
+			}
+		} else {
+			start, end = b[1], a[0]
+			if start < end-limit {
+				start = end - limit
+			}
+		}
+	default:
+		return nil, false
+	}
+
+	if start < 0 {
+		start = 0
+	}
+	if end > n {
+		end = n
+	}
+	if start >= end {
+		return []*HistoryEntry{}, true
+	}
+	return entries[start:end], true
+}
+
+// Returns the history key for CHATHISTORY target `target`, the client has to
+// be on a channel to read its history
+func (c *Client) HistoryTarget(target string) (string, error) {
+	if c.Server.IsChannelPrefix(target[0]) {
+		if !c.Server.HasChannel(target) {
+			return "", ERR_HISTORY_TARGET
+		}
+		ch := c.Server.GetChannel(target)
+		if !ch.IsMember(c) {
+			return "", ERR_HISTORY_TARGET
+		}
+		return c.Server.HistoryKey(ch), nil
+	}
+
+	// DMs are only kept for logged in clients. The target is the account of
+	//  the user on that nick, or else taken as an account name
+	if c.Account == "" {
+		return "", ERR_HISTORY_ACCOUNT
+	}
+	account := target
+	if cl := c.Server.FindUserByNick(target); cl != nil && cl.Account != "" {
+		account = cl.Account
+	}
+	return c.Server.DMKey(c.Account, account), nil
+}
+
+// Sends a CHATHISTORY failure, which draft/chathistory clients always get as
+// a FAIL reply
+func (c *Client) FailHistory(code string, desc string, context ...string) {
+	c.Fail(CLIENT_CHATHISTORY, code, context...).Also(CAP_CHATHISTORY).Send(desc)
+}
+
+// Replays entries to the client in a `chathistory` batch
+func (c *Client) SendHistory(target string, entries []*HistoryEntry) {
+	b := c.StartBatch(BATCH_CHATHISTORY, target)
+	for _, e := range entries {
+		b.Send(e.Response(c.Server))
+	}
+	b.End()
+}
+
+// Returns the targets the client has history with, along with the time of
+// their latest message between `from` and `to`, and sends at most `limit` of
+// them in a `draft/chathistory-targets` batch
+func (c *Client) SendHistoryTargets(from time.Time, to time.Time, limit int) {
+	if from.After(to) {
+		from, to = to, from
+	}
+
+	type target struct {
+		Name string
+		Time time.Time
+	}
+	targets := make([]target, 0)
+
+	account := c.Server.Fold(c.Account)
+	for _, key := range c.Server.History.Keys() {
+		var name string
+
+		if pair := strings.SplitN(key, " ", 2); len(pair) == 2 {
+			// DMs are only listed for the two accounts they are between
+			if account == "" {
+				continue
+			} else if pair[0] == account {
+				name = pair[1]
+			} else if pair[1] == account {
+				name = pair[0]
+			} else {
+				continue
+			}
+		} else {
+			if !c.Server.HasChannel(key) {
+				continue
+			}
+			ch := c.Server.GetChannel(key)
+			if !ch.IsMember(c) {
+				continue
+			}
+			name = ch.GetName()
+		}
+
+		entries := c.Server.GetHistory(key)
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			if entries[idx].Time.After(from) && entries[idx].Time.Before(to) {
+				targets = append(targets, target{name, entries[idx].Time})
+				break
+			}
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Time.Before(targets[j].Time)
+	})
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+
+	b := c.StartBatch(BATCH_CHATHISTORY_TARGETS)
+	for _, v := range targets {
+		b.Send(c.ServerCmd(CLIENT_CHATHISTORY).Set("TARGETS").Set(v.Name).
+			SetF("timestamp=%s", v.Time.UTC().Format(SERVER_TIME_FORMAT)))
+	}
+	b.End()
+}
@@ -0,0 +1,210 @@
+package gircd
+
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func TestDMHistoryByAccount(t *testing.T) {
+	s := newTestServer()
+	alice, aliceConn := newTestClient(s, "alice", CAP_CHATHISTORY)
+	bob, bobConn := newTestClient(s, "bob", CAP_CHATHISTORY)
+	alice.Account, bob.Account = "alice", "bob"
+
+	testSend(alice, "PRIVMSG bob :secret")
+	bobConn.Lines()
+
+	// Somebody else takes the nick bob was using
+	s.SetNick(bob, "robert")
+	eve, eveConn := newTestClient(s, "bob", CAP_CHATHISTORY)
+
+	testSend(eve, "CHATHISTORY LATEST alice * 10")
+	if got := eveConn.Lines(); hasLine(got, "secret") || !hasLine(got, "FAIL CHATHISTORY INVALID_TARGET") {
+		t.Errorf("logged out client: got %q, want INVALID_TARGET", got)
+	}
+
+	eve.Account = "eve"
+	testSend(eve, "CHATHISTORY LATEST alice * 10")
+	if got := eveConn.Lines(); hasLine(got, "secret") {
+		t.Errorf("new owner of the nick read its DMs: %q", got)
+	}
+
+	testSend(bob, "CHATHISTORY LATEST alice * 10")
+	if got := bobConn.Lines(); !hasLine(got, "PRIVMSG bob :secret") {
+		t.Errorf("account owner lost its DMs after a nick change: %q", got)
+	}
+
+	testSend(alice, "CHATHISTORY LATEST robert * 10")
+	if got := aliceConn.Lines(); !hasLine(got, "PRIVMSG bob :secret") {
+		t.Errorf("DMs not found by the current nick of the account: %q", got)
+	}
+}
+
+func TestDMHistoryNeedsAccounts(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	newTestClient(s, "bob")
+
+	testSend(alice, "PRIVMSG bob :hi")
+	if keys := s.History.Keys(); len(keys) != 0 {
+		t.Errorf("DMs between logged out clients were kept under %q", keys)
+	}
+}
+
+func TestDMHistoryOneSideLoggedOut(t *testing.T) {
+	s := newTestServer()
+	alice, aliceConn := newTestClient(s, "alice", CAP_CHATHISTORY, CAP_BATCH)
+	bob, bobConn := newTestClient(s, "bob", CAP_CHATHISTORY)
+	alice.Account = "alice"
+
+	testSend(alice, "PRIVMSG bob :hi")
+	testSend(bob, "PRIVMSG alice :hello")
+	aliceConn.Lines()
+	bobConn.Lines()
+	if keys := s.History.Keys(); len(keys) != 0 {
+		t.Errorf("DMs with a logged out client were kept under %q", keys)
+	}
+
+	// Both sides get told why there is nothing
+	testSend(alice, "CHATHISTORY LATEST bob * 10")
+	got := aliceConn.Lines()
+	if !hasLine(got, ":irc.test NOTE CHATHISTORY ACCOUNT_REQUIRED bob :bob is not logged in") {
+		t.Errorf("logged in side: got %q, want ACCOUNT_REQUIRED", got)
+	}
+	if !hasLine(got, " BATCH +") || hasLine(got, " PRIVMSG ") {
+		t.Errorf("logged in side: got %q, want an empty batch", got)
+	}
+
+	testSend(bob, "CHATHISTORY LATEST alice * 10")
+	want := ":irc.test FAIL CHATHISTORY INVALID_TARGET LATEST alice :Direct message history is only kept for logged in users"
+	if got := bobConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("logged out side: got %q, want %q", got, want)
+	}
+}
+
+func TestChannelHistoryGC(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_CHATHISTORY)
+	eve, eveConn := newTestClient(s, "eve", CAP_CHATHISTORY)
+	testSend(alice, "JOIN #x")
+	testSend(alice, "PRIVMSG #x :old")
+
+	testSend(alice, "PART #x")
+	if s.HasChannel("#x") {
+		t.Fatalf("empty channel was not GCed")
+	}
+	if entries := s.History.Get("#x"); len(entries) != 1 {
+		t.Errorf("got %d entries after the channel was GCed, want 1", len(entries))
+	}
+
+	// Reading it takes being on the channel, whether it exists or not
+	testSend(eve, "CHATHISTORY LATEST #x * 10")
+	if got := eveConn.Lines(); hasLine(got, ":old") || !hasLine(got, "FAIL CHATHISTORY INVALID_TARGET") {
+		t.Errorf("GCed channel: got %q, want INVALID_TARGET", got)
+	}
+
+	testSend(alice, "JOIN #x")
+	conn.Lines()
+	testSend(alice, "CHATHISTORY LATEST #x * 10")
+	if got := conn.Lines(); !hasLine(got, "PRIVMSG #x :old") {
+		t.Errorf("history lost when the channel was GCed: %q", got)
+	}
+
+	testSend(eve, "CHATHISTORY LATEST #x * 10")
+	if got := eveConn.Lines(); hasLine(got, ":old") || !hasLine(got, "FAIL CHATHISTORY INVALID_TARGET") {
+		t.Errorf("non-member: got %q, want INVALID_TARGET", got)
+	}
+}
+
+func TestLogHistoryDelete(t *testing.T) {
+	s := newTestServer()
+	path := filepath.Join(t.TempDir(), "history.log")
+	h, err := NewLogHistory(path, s.RetentionFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	h.Add("#a", &HistoryEntry{MsgID: "1", Time: now, Text: "gone"}, HistoryRetention{})
+	h.Add("#b", &HistoryEntry{MsgID: "2", Time: now, Text: "kept"}, HistoryRetention{})
+	h.Delete("#a")
+	h.File.Close()
+
+	// Deletes are replayed along with everything else
+	h, err = NewLogHistory(path, s.RetentionFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.File.Close()
+	if entries := h.Get("#a"); len(entries) != 0 {
+		t.Errorf("deleted key came back with %d entries", len(entries))
+	}
+	if entries := h.Get("#b"); len(entries) != 1 || entries[0].Text != "kept" {
+		t.Errorf("other key lost its entries: %v", entries)
+	}
+}
+
+func TestLogHistoryRetention(t *testing.T) {
+	s := newTestServer()
+	s.HistoryRetention = HistoryRetention{MaxAge: time.Hour}
+	s.SetChannelRetention("#Small", HistoryRetention{MaxEntries: 2})
+
+	// Written without any retention, as if the config changed since
+	path := filepath.Join(t.TempDir(), "history.log")
+	h, err := NewLogHistory(path, func(string) HistoryRetention { return HistoryRetention{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for idx := 0; idx < 5; idx++ {
+		h.Add("#small", &HistoryEntry{Time: old, Text: fmt.Sprint(idx)}, HistoryRetention{})
+		h.Add("#big", &HistoryEntry{Time: old, Text: "old"}, HistoryRetention{})
+	}
+	h.Add("#big", &HistoryEntry{Time: time.Now(), Text: "new"}, HistoryRetention{})
+	h.Add("#gone", &HistoryEntry{Time: old, Text: "old"}, HistoryRetention{})
+	h.Delete("#gone")
+	h.File.Close()
+
+	h, err = NewLogHistory(path, s.RetentionFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.File.Close()
+
+	if entries := h.Get("#small"); len(entries) != 2 || entries[0].Text != "3" {
+		t.Errorf("#small: got %v, want the last 2 entries", entries)
+	}
+	if entries := h.Get("#big"); len(entries) != 1 || entries[0].Text != "new" {
+		t.Errorf("#big: got %v, want the entry within MaxAge", entries)
+	}
+
+	// Only what is left is written back
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("compacted log has %d lines, want 3", n)
+	}
+	if keys := h.Keys(); len(keys) != 2 {
+		t.Errorf("got keys %q, want #small and #big", keys)
+	}
+}
+
+func TestChannelRetention(t *testing.T) {
+	s := newTestServer()
+	s.SetChannelRetention("#Quiet", HistoryRetention{MaxEntries: 1})
+	alice, _ := newTestClient(s, "alice")
+	testSend(alice, "JOIN #quiet,#x")
+
+	for _, line := range []string{"PRIVMSG #quiet :a", "PRIVMSG #quiet :b", "PRIVMSG #x :a", "PRIVMSG #x :b"} {
+		testSend(alice, line)
+	}
+	if entries := s.GetHistory("#quiet"); len(entries) != 1 || entries[0].Text != "b" {
+		t.Errorf("#quiet: got %v, want the last entry", entries)
+	}
+	if entries := s.GetHistory("#x"); len(entries) != 2 {
+		t.Errorf("#x: got %d entries, want 2", len(entries))
+	}
+}
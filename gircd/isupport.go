@@ -0,0 +1,69 @@
+package gircd
+
+// A single ISUPPORT token, an empty value sends the bare token
+type ISupportToken struct {
+	Name  string
+	Value string
+}
+
+// Returns the token as sent in RPL_ISUPPORT (e.g. `NICKLEN=30`)
+func (t ISupportToken) String() string {
+	if t.Value == "" {
+		return t.Name
+	}
+	return t.Name + "=" + t.Value
+}
+
+// Ordered set of ISUPPORT tokens advertised to clients
+type ISupport struct {
+	Tokens []ISupportToken
+}
+
+func NewISupport() *ISupport {
+	return &ISupport{
+		Tokens: make([]ISupportToken, 0),
+	}
+}
+
+// Sets token `name` to `value`, replacing any existing value
+func (i *ISupport) Set(name string, value string) *ISupport {
+	for idx, v := range i.Tokens {
+		if v.Name == name {
+			i.Tokens[idx].Value = value
+			return i
+		}
+	}
+	i.Tokens = append(i.Tokens, ISupportToken{name, value})
+	return i
+}
+
+// Returns the value of token `name`, and whether it is set
+func (i *ISupport) Get(name string) (string, bool) {
+	for _, v := range i.Tokens {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+// Removes token `name`
+func (i *ISupport) Rmv(name string) {
+	for idx, v := range i.Tokens {
+		if v.Name == name {
+			i.Tokens = append(i.Tokens[:idx], i.Tokens[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Splits the tokens into RPL_ISUPPORT lines of at most 13 tokens (the most
+// that fit next to the target and trailing parameter), keeping each line's
+// tokens within `size` bytes
+func (i *ISupport) Lines(size int) []string {
+	tokens := make([]string, 0, len(i.Tokens))
+	for _, v := range i.Tokens {
+		tokens = append(tokens, v.String())
+	}
+	return JoinTokens(tokens, 13, size)
+}
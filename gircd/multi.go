@@ -81,7 +81,7 @@ func (u *Update) Update() bool {
 		if (time.Now().Sub(u.Get("start").(time.Time))) > LOGIN_TIMEOUT_DUR {
 			// Is the user still in the correct state
 			u.CLIENT.Lock.RLock()
-			c := (u.CLIENT.State == STATE_WAIT_NICK || u.CLIENT.State == STATE_WAIT_USER)
+			c := (u.CLIENT.State == STATE_REGISTERING)
 			u.CLIENT.Lock.RUnlock()
 
 			if c {
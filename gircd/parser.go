@@ -1,23 +1,72 @@
 package gircd
 
+import "strconv"
 import "strings"
+import "sync/atomic"
+import "time"
 import "log"
 
 type Msg struct {
 	Tag    string
 	Values []string
 	Client *Client
+
+	// Message tags the line was sent with
+	Tags map[string]string
+
+	// Size of the line the message was read from
+	Size int
 }
 
 // Function definition for a parser function
 type ParserF func(i *Client, m *Msg)
 
-// Create a map of parser functions
-var PARSERS map[string]ParserF = make(map[string]ParserF)
+// Commands that can be sent in any state (e.g. PING, QUIT)
+const STATE_ANY = -1
+
+// A command the server understands, along with what Parse checks before
+// calling its handler
+type Command struct {
+	Tag string
+	F   ParserF
+
+	// How many values the command takes, extra values past MaxParams are
+	//  dropped (a MaxParams below zero means there is no limit)
+	MinParams int
+	MaxParams int
+
+	// The state the client has to be in, or STATE_ANY
+	State int
+}
+
+// Create a map of commands
+var PARSERS map[string]*Command = make(map[string]*Command)
+
+// Add a function f with tag s to the parsers, by default the command takes
+// any number of values and requires the client to be registered
+func PF(s string, f ParserF) *Command {
+	cmd := &Command{
+		Tag:       s,
+		F:         f,
+		MinParams: 0,
+		MaxParams: -1,
+		State:     STATE_ACTIVE,
+	}
+	PARSERS[s] = cmd
+	return cmd
+}
+
+// Sets the min and max number of values for the command
+func (c *Command) Params(min, max int) *Command {
+	c.MinParams = min
+	c.MaxParams = max
+	return c
+}
 
-// Add a function f with tag s to the parsers
-func PF(s string, f ParserF) {
-	PARSERS[s] = f
+// Sets the state the client has to be in to use the command
+func (c *Command) Requires(state int) *Command {
+	c.State = state
+	return c
 }
 
 func HasParserFunc(s string) bool {
@@ -28,45 +77,81 @@ func HasParserFunc(s string) bool {
 }
 
 func GetParserFunc(s string) ParserF {
-	val, _ := PARSERS[s]
-	return val
+	if val, has := PARSERS[s]; has {
+		return val.F
+	}
+	return nil
 }
 
 func NewMsg(tag string, vals ...string) *Msg {
 	return &Msg{
 		Tag:    tag,
 		Values: vals,
+		Tags:   make(map[string]string),
 	}
 }
 
 func SplitMsg(s string) []string {
 	base := make([]string, 0)
-	if strings.Contains(s, ":") {
-		a := strings.SplitN(s, ":", 2)
-		if len(a) != 2 {
-			log.Printf("[WARN] SplitMsg failure: %s\n", s)
-			return nil
+
+	// The trailing value starts with a `:` at the start of a word, colons
+	//  anywhere else (e.g. in timestamps) are part of the value
+	if idx := strings.Index(" "+s, " :"); idx != -1 {
+		head := ""
+		if idx > 0 {
+			head = s[:idx-1]
 		}
-		for _, substr := range strings.Split(a[0], " ") {
+		for _, substr := range strings.Split(head, " ") {
 			if substr == "" {
 				continue
 			}
 			base = append(base, substr)
 		}
-		base = append(base, a[1])
+		base = append(base, s[idx+1:])
 		return base
 	}
 	return strings.Split(s, " ")
 }
 
+// Splits the first word off of a line, dropping the spaces after it
+func splitWord(s string) (string, string) {
+	sd := strings.SplitN(s, " ", 2)
+	if len(sd) == 1 {
+		return sd[0], ""
+	}
+	return sd[0], strings.TrimLeft(sd[1], " ")
+}
+
 func NewMsgFrom(data string) *Msg {
-	sd := strings.SplitN(data, " ", 2)
-	if len(sd) != 2 {
+	line := data
+
+	// Tags come first, then an optional prefix (which clients have no use for)
+	var tags string
+	if strings.HasPrefix(line, "@") {
+		tags, line = splitWord(line[1:])
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line = splitWord(line)
+	}
+
+	sd := strings.SplitN(line, " ", 2)
+	if sd[0] == "" {
 		log.Printf("[WARN] NewMsgFrom failure: %s\n", data)
 		return nil
 	}
-	sf := SplitMsg(sd[1])
-	return NewMsg(sd[0], sf...)
+
+	// Commands are case insensitive, some (e.g. AWAY, QUIT) are valid
+	//  without any values
+	tag := strings.ToUpper(sd[0])
+	var msg *Msg
+	if len(sd) == 1 {
+		msg = NewMsg(tag)
+	} else {
+		msg = NewMsg(tag, SplitMsg(sd[1])...)
+	}
+	msg.Tags = ParseTags(tags)
+	msg.Size = len(data)
+	return msg
 }
 
 func (m *Msg) Debug(i *Client) {
@@ -78,66 +163,186 @@ func (m *Msg) Parse(i *Client) {
 	m.Client = i
 
 	er := func(txt string) {
-		i.LogF("ParseError: %s (%s, %s, %s)\n", txt, m.Tag, len(m.Values), m.Values)
+		i.LogF("ParseError: %s (%s, %d, %s)\n", txt, m.Tag, len(m.Values), m.Values)
 	}
 	i.LogF("Attempting to parse line with tag: '%s'\n", m.Tag)
 
+	atomic.AddInt64(&i.Stats.RecvQ, -int64(m.Size))
+	atomic.AddInt64(&i.Stats.RecvMsgs, 1)
+
+	// Every reply to a labeled command (errors included) goes out at once
+	i.StartLabel(m.Tags[TAG_LABEL])
+	defer i.FlushLabel()
+
 	// Do we have a parser to handle this?
-	if !HasParserFunc(m.Tag) {
+	cmd, has := PARSERS[m.Tag]
+	if !has {
 		er("Could not find parser function for tag!")
+		i.Resp(ERR_UNKNOWNCOMMAND).Set(m.Tag).Set(":Unknown command").Send()
+		return
+	}
+	i.Server.CommandStats.Add(m.Tag, m.Size)
+
+	// Anything but keepalives counts as activity for idle times
+	if m.Tag != CLIENT_PING && m.Tag != CLIENT_PONG {
+		i.MarkActive()
+	}
+
+	// Is the client in the right state for this command?
+	if cmd.State == STATE_ACTIVE && i.State != STATE_ACTIVE {
+		er("Active state required")
+		i.Resp(ERR_NOTREGISTERED).Set(":You have not registered").Send()
+		return
+	}
+	if cmd.State == STATE_REGISTERING && i.State != STATE_REGISTERING {
+		er("Registering state required")
+		i.Resp(ERR_ALREADYREGISTRED).Set(":You may not reregister").Send()
 		return
 	}
 
+	if len(m.Values) < cmd.MinParams {
+		er("Not enough values")
+		i.Resp(ERR_NEEDMOREPARAMS).Set(m.Tag).Set(":Not enough parameters").Send()
+		return
+	}
+	if cmd.MaxParams >= 0 && len(m.Values) > cmd.MaxParams {
+		m.Values = m.Values[:cmd.MaxParams]
+	}
+
 	// Actually parse the message
-	GetParserFunc(m.Tag)(i, m)
+	cmd.F(i, m)
 }
 
 func (m *Msg) Error(s string) {
-	m.Client.LogF("ParseError: %s (%s, %s, %s)\n", s, m.Tag, len(m.Values), m.Values)
+	m.Client.LogF("ParseError: %s (%s, %d, %s)\n", s, m.Tag, len(m.Values), m.Values)
+}
+
+// Returns true if a modestring starts with `+` or `-`
+func validModeString(s string) bool {
+	return len(s) > 0 && (s[0] == '+' || s[0] == '-')
 }
 
 func InitParser() {
-	PF("NICK", func(i *Client, m *Msg) {
-		// The user can only change nick for first auth, or after auth is complete
-		if i.State != STATE_WAIT_NICK && i.State != STATE_ACTIVE {
-			m.Error("Not waiting for nick (not WAIT_NICK or ACTIVE)")
+	// The password is only checked once, when registration completes
+	PF("PASS", func(i *Client, m *Msg) {
+		i.Pass = m.Values[0]
+	}).Params(1, 1).Requires(STATE_REGISTERING)
+
+	PF("CAP", func(i *Client, m *Msg) {
+		switch strings.ToUpper(m.Values[0]) {
+		case "LS":
+			version := 0
+			if len(m.Values) > 1 {
+				version, _ = strconv.Atoi(m.Values[1])
+			}
+			i.CapLS(version)
+		case "LIST":
+			i.SendCapReply("LIST", i.CapList())
+		case "REQ":
+			if len(m.Values) < 2 {
+				i.Resp(ERR_NEEDMOREPARAMS).Set("CAP").Set(":Not enough parameters").Send()
+				return
+			}
+			i.CapREQ(m.Values[1])
+		case "END":
+			// Registration can't wait on an unfinished SASL exchange
+			i.AbortSASL()
+			i.CapHold = false
+			i.TryRegister()
+		default:
+			i.Resp(ERR_INVALIDCAPCMD).Set(m.Values[0]).Set(":Invalid CAP command").Send()
+		}
+	}).Params(1, 2).Requires(STATE_ANY)
+
+	// SASL is available to clients that enabled it. Logging in after
+	//  registration lets account-notify peers know with ACCOUNT
+	PF("AUTHENTICATE", func(i *Client, m *Msg) {
+		if !i.HasCap(CAP_SASL) {
+			i.Resp(ERR_SASLFAIL).Set(":SASL authentication failed").Send()
+			return
+		}
+
+		if i.Account != "" {
+			i.Resp(ERR_SASLALREADY).Set(":You have already authenticated using SASL").Send()
 			return
 		}
+		i.Authenticate(m.Values[0])
+	}).Params(1, 1).Requires(STATE_ANY)
 
-		// Require exactly one value
-		if len(m.Values) != 1 {
-			m.Error("Need 1 value for NICK message")
+	// The user can change nick while registering, or after auth is complete
+	PF("NICK", func(i *Client, m *Msg) {
+		if len(m.Values) < 1 || m.Values[0] == "" {
+			i.Resp(ERR_NONICKNAMEGIVEN).Set(":No nickname given").Send()
 			return
 		}
 
 		n, e := Sanatize(m.Values[0])
-		if !e {
+		if !e || len(n) > i.Server.NickLen {
 			m.Error("Nickname is invalid for NICK message")
 			i.Resp(ERR_ERRONEUSNICKNAME).Set(m.Values[0]).Set(":Invalid Nickname!").Send()
 			return
 		}
 
+		// Changing to the same nick is a no-op, changing just its case is fine
+		if n == i.Nick {
+			return
+		}
+
 		// Check if the nick is already in use
-		if m.Client.Server.FindUserByNick(n) != nil {
+		if cl := i.Server.FindUserByNick(n); cl != nil && cl != i {
 			m.Error("Nickname is already in use")
 			i.Resp(ERR_NICKNAMEINUSE).Set(n).Set(":That nickname is already in use!").Send()
 			return
 		}
 
-		i.Nick = n
-		i.SetState(STATE_WAIT_USER)
-	})
+		// Nicks are held for a while for whoever used them last (nick-delay)
+		if i.Server.WhoWas.IsHeld(i.Server.Fold(n), i.GetAddr()) {
+			m.Error("Nickname is being held")
+			i.Resp(ERR_UNAVAILRESOURCE).Set(n).Set(":Nick/channel is temporarily unavailable").Send()
+			return
+		}
+
+		// Before registration there is nobody to tell about the nick
+		if i.State != STATE_ACTIVE {
+			i.Server.SetNick(i, n)
+			i.TryRegister()
+			return
+		}
+
+		// Registered users can only change nick every so often
+		if wait := NICK_CHANGE_DELAY - time.Now().Sub(i.LastNickChange); wait > 0 {
+			m.Error("Nick change too fast")
+			i.Resp(ERR_NICKTOOFAST).Set(n).
+				SetF(":Nick change too fast. Please wait %d seconds.", int(wait.Seconds())+1).
+				Send()
+			return
+		}
 
+		// Keep the old identity around for WHOWAS
+		i.Server.WhoWas.Add(i)
+
+		// The NICK line carries the old hostmask, so build it before changing
+		nick := i.Cmd(CLIENT_NICK).SetF(":%s", n)
+		i.Server.SetNick(i, n)
+		i.LastNickChange = time.Now()
+
+		// Everyone sharing a channel gets told exactly once
+		nick.Send()
+		for _, v := range i.Peers() {
+			nick.SendTo(v)
+		}
+	}).Params(0, 1).Requires(STATE_ANY)
+
+	// The user can only send USER messages on auth
 	PF("USER", func(i *Client, m *Msg) {
-		// The user can only send USER messages on auth
-		if i.State != STATE_WAIT_USER {
-			m.Error("Not waiting for user (not WAIT_USER)")
+		if m.Values[0] == "" {
+			i.Resp(ERR_NEEDMOREPARAMS).Set("USER").Set(":Not enough parameters").Send()
 			return
 		}
 
-		// Require exactly four values
-		if len(m.Values) != 4 {
-			m.Error("Need exactly 4 values for user message")
+		// These would make the hostmask ambiguous, there is no numeric for it
+		if strings.ContainsAny(m.Values[0], "!@") {
+			m.Fail("INVALID_USERNAME", "Your username is not valid", m.Values[0])
 			return
 		}
 
@@ -147,126 +352,280 @@ func InitParser() {
 		// i.Mode.Modes = m.Values[1]
 		i.Unused = m.Values[2]
 		i.RealName = m.Values[3]
+		if len(i.RealName) > i.Server.NameLen {
+			i.RealName = i.RealName[:i.Server.NameLen]
+		}
 
-		// The user is authed up and ready to go
-		i.SetState(STATE_ACTIVE)
-		i.Init()
-	})
+		i.TryRegister()
+	}).Params(4, 4).Requires(STATE_REGISTERING)
 
-	PF("JOIN", func(i *Client, m *Msg) {
-		// User must be authed and active
-		if i.State != STATE_ACTIVE {
-			m.Error("Active state required for JOIN")
+	PF("SETNAME", func(i *Client, m *Msg) {
+		if m.Values[0] == "" || len(m.Values[0]) > i.Server.NameLen {
+			m.Fail("INVALID_REALNAME", "Realname is not valid")
 			return
 		}
+		i.SetName(m.Values[0])
+	}).Params(1, 1)
 
-		// Require 1 to 2 values for JOIN
-		if len(m.Values) != 2 && len(m.Values) != 1 {
-			m.Error("JOIN requires 1-2 values")
+	PF("JOIN", func(i *Client, m *Msg) {
+		// `JOIN 0` parts every channel the user is on
+		if m.Values[0] == "0" {
+			for _, ch := range i.ChannelList() {
+				ch.ClientPart(i, "")
+			}
 			return
 		}
 
-		// A user can join up to MAX_CHANNELS, and otherwise is denied
-		if i.Channels > MAX_CHANNELS {
-			i.Resp(ERR_TOOMANYCHANNELS).Set(m.Values[0]).SetF(":You may join a maximum of %d channels!", MAX_CHANNELS).Send()
-			return
+		// Channels and keys are comma separated lists, matched up by position
+		names := strings.Split(m.Values[0], ",")
+		keys := make([]string, 0)
+		if len(m.Values) == 2 {
+			keys = strings.Split(m.Values[1], ",")
 		}
 
-		// Null password by default
-		var password string = ""
+		for idx, name := range names {
+			// Null password by default
+			var password string = ""
 
-		// Set password if provided
-		if len(m.Values) == 2 {
-			password = m.Values[1]
-		}
+			// Set password if provided
+			if idx < len(keys) {
+				password = keys[idx]
+			}
 
-		// Get a channel (either by creating it, or grabbing it)
-		var c *Channel
-		if i.Server.HasChannel(m.Values[0]) {
-			c = i.Server.GetChannel(m.Values[0])
-		} else {
-			c = i.Server.NewChannel(string(m.Values[0][0]), m.Values[0][1:])
-		}
+			// Unknown prefixes can't be channels at all, anything else that is
+			//  invalid is a bad mask
+			if name == "" || !i.Server.IsChannelPrefix(name[0]) {
+				i.Resp(ERR_NOSUCHCHANNEL).Set(name).Set(":No such channel").Send()
+				continue
+			}
+			if !i.Server.ValidChannelName(name) {
+				i.Resp(ERR_BADCHANMASK).Set(name).Set(":Bad Channel Mask").Send()
+				continue
+			}
 
-		// This is a weird edge case in the RFC, there is no valid reply to a user trying to join
-		//  a channel they are already on. In this case we just ignore it. Maybe NOTICE?
-		if c.IsMember(i) {
-			m.Error("Client is already a member of the channel")
-			return
+			// A user can join up to MAX_CHANNELS, and otherwise is denied
+			if i.ChannelCount() >= MAX_CHANNELS {
+				i.Resp(ERR_TOOMANYCHANNELS).Set(name).SetF(":You may join a maximum of %d channels!", MAX_CHANNELS).Send()
+				return
+			}
+
+			// Get a channel (either by creating it, or grabbing it)
+			var c *Channel
+			if i.Server.HasChannel(name) {
+				c = i.Server.GetChannel(name)
+			} else {
+				c = i.Server.NewChannel(name[:1], name[1:])
+			}
+
+			// This is a weird edge case in the RFC, there is no valid reply to a user trying to join
+			//  a channel they are already on. In this case we just ignore it
+			if c.IsMember(i) {
+				m.Error("Client is already a member of the channel")
+				continue
+			}
+
+			// Check if the PW is correct
+			if !c.CheckPassword(password) {
+				i.Resp(ERR_BADCHANNELKEY).Set(c.GetName()).Set(":Invalid Key For Channel!").Send()
+				continue
+			}
+
+			c.ClientJoin(i)
 		}
+	}).Params(1, 2)
 
-		// Check if the PW is correct
-		if !c.CheckPassword(password) {
-			i.Resp(ERR_BADCHANNELKEY).Set(c.GetName()).Set(":Invalid Key For Channel!").Send()
+	PF("QUIT", func(i *Client, m *Msg) {
+		// Quit messages are prefixed so they can't be mistaken for server ones
+		reason := "Client Quit"
+		if len(m.Values) > 0 && m.Values[0] != "" {
+			reason = "Quit: " + m.Values[0]
+		}
+		i.ForceDC(reason)
+	}).Params(0, 1).Requires(STATE_ANY)
+
+	PF("AWAY", func(i *Client, m *Msg) {
+		// No (or an empty) message marks the user as back
+		if len(m.Values) < 1 || m.Values[0] == "" {
+			i.SetAway("")
+			i.Resp(RPL_UNAWAY).Set(":You are no longer marked as being away").Send()
 			return
 		}
 
-		c.ClientJoin(i)
-	})
-
-	PF("QUIT", func(i *Client, m *Msg) {
-		i.ForceDC("Client Quit")
-	})
+		msg := m.Values[0]
+		if len(msg) > i.Server.AwayLen {
+			msg = msg[:i.Server.AwayLen]
+		}
+		i.SetAway(msg)
+		i.Resp(RPL_NOWAWAY).Set(":You have been marked as being away").Send()
 
-	PF("PONG", func(i *Client, m *Msg) {
-		if len(m.Values) != 1 {
-			m.Error("PONG requires exactly 1 value!")
-			return
+		// Clients show the message as it was sent, so let them know
+		if len(msg) < len(m.Values[0]) {
+			i.Warn(CLIENT_AWAY, "MESSAGE_TRUNCATED").SendF("Your away message was cut to %d characters", i.Server.AwayLen)
 		}
+	}).Params(0, 1)
 
+	PF("PONG", func(i *Client, m *Msg) {
 		i.LogF("PONG DATA: %s", m.Values[0])
-	})
+	}).Params(1, 2).Requires(STATE_ANY)
 
 	PF("PING", func(i *Client, m *Msg) {
-		i.LogF("%s, %s", m.Values, len(m.Values))
-		if len(m.Values) != 1 {
-			m.Error("PING requires exactly 1 value!")
-			return
+		// TODO: Limit this
+		i.ServerCmd(CLIENT_PONG).Set(i.Server.GetHash()).SetF(":%s", m.Values[0]).Send()
+	}).Params(1, 2).Requires(STATE_ANY)
+
+	// PRIVMSG, NOTICE and TAGMSG only differ in what they carry and the
+	//  replies they get
+	message := func(tag string) ParserF {
+		return func(i *Client, m *Msg) {
+			// These have their own numerics for missing values
+			if len(m.Values) < 1 || m.Values[0] == "" {
+				i.Resp(ERR_NORECIPIENT).SetF(":No recipient given (%s)", tag).Send()
+				return
+			}
+			if tag != CLIENT_TAGMSG && (len(m.Values) < 2 || m.Values[1] == "") {
+				i.Resp(ERR_NOTEXTTOSEND).Set(":No text to send").Send()
+				return
+			}
+
+			// TAGMSG carries nothing but tags, so only goes to clients that
+			//  understand them
+			build := func(target string) *Response {
+				r := i.Cmd(tag).Set(target).SetTags(m.ClientTags())
+				if tag == CLIENT_TAGMSG {
+					return r.RequireCap(CAP_MESSAGE_TAGS)
+				}
+				return r.SetF(":%s", m.Values[1])
+			}
+
+			// Targets are comma separated, up to MAXTARGETS of them
+			targets := strings.Split(m.Values[0], ",")
+			if len(targets) > i.Server.MaxTargets {
+				i.Resp(ERR_TOOMANYTARGETS).Set(m.Values[0]).
+					SetF(":Too many recipients, only %d are allowed", i.Server.MaxTargets).
+					Send()
+				return
+			}
+
+			for _, target := range targets {
+				if target == "" {
+					continue
+				}
+
+				// If the server has the channel, send the message to it
+				if i.Server.HasChannel(target) {
+					ch := i.Server.GetChannel(target)
+					// If we are not a member of the channel, we can't send messages to it
+					if !ch.IsMember(i) {
+						i.Resp(ERR_CANNOTSENDTOCHAN).Set(target).
+							Set(":You must be a member of the channel to send messages to it").
+							Send()
+						continue
+					}
+					ch.Message(i, build(ch.GetName()))
+					continue
+				}
+
+				// Try finding a client for the user
+				cl := i.Server.FindUserByNick(target)
+				if cl == nil {
+					m.Error("User does not exist!")
+					i.Resp(ERR_NOSUCHNICK).Set(target).Set(":No such nick/channel").Send()
+					continue
+				}
+
+				// TODO: sanatize the messsage
+				r := build(cl.Nick)
+				r.SendTo(cl)
+				// DM history is kept by account, so both sides have to be logged in
+				if tag != CLIENT_TAGMSG && i.Account != "" && cl.Account != "" {
+					i.Server.AddHistory(i.Server.DMKey(i.Account, cl.Account), r)
+				}
+
+				// Let the sender know their message might not be read for a while
+				if tag == CLIENT_PRIVMSG && cl.Away != "" {
+					i.Resp(RPL_AWAY).Set(cl.Nick).SetF(":%s", cl.Away).Send()
+				}
+			}
 		}
+	}
 
-		// TODO: Limit this
-		i.Resp(CLIENT_PONG).SetF(":%s", m.Values[0]).Send()
-	})
+	PF("PRIVMSG", message(CLIENT_PRIVMSG)).Params(0, 2)
+	PF("NOTICE", message(CLIENT_NOTICE)).Params(0, 2)
+	PF("TAGMSG", message(CLIENT_TAGMSG)).Params(0, 1)
 
-	PF("PRIVMSG", func(i *Client, m *Msg) {
-		// Requires 2 values
-		if len(m.Values) != 2 {
-			m.Error("PRIVMSG requries exactly 2 values!")
+	// CHATHISTORY <subcommand> <target> <ref> [ref] <limit>, or
+	//  CHATHISTORY TARGETS <timestamp> <timestamp> <limit>
+	PF("CHATHISTORY", func(i *Client, m *Msg) {
+		sub := strings.ToUpper(m.Values[0])
+		if i.Server.History == nil {
+			i.FailHistory("UNKNOWN_COMMAND", "History is not available", sub)
 			return
 		}
 
-		// If the server has the channel, send the message to it
-		if i.Server.HasChannel(m.Values[0]) {
-			ch := i.Server.GetChannel(m.Values[0])
-			// If we are not a member of the channel, we can't send messages to it
-			if !ch.IsMember(i) {
-				i.Resp(ERR_CANNOTSENDTOCHAN).Set(m.Values[0]).
-					Set(":You must be a member of the channel to send messages to it").
-					Send()
-			}
-			ch.Message(i, m.Values[1])
+		// The limit is always last, and capped at what we advertise
+		limit, err := strconv.Atoi(m.Values[len(m.Values)-1])
+		if err != nil || limit < 1 {
+			i.FailHistory("INVALID_PARAMS", "Invalid limit", sub)
 			return
 		}
+		if limit > HISTORY_MAX_LIMIT {
+			limit = HISTORY_MAX_LIMIT
+		}
+		args := m.Values[1 : len(m.Values)-1]
 
-		// Try finding a client for the user
-		cl := i.Server.FindUserByNick(m.Values[0])
-		if cl == nil {
-			m.Error("User does not exist!")
-			i.Resp(ERR_NORECIPIENT).Set("User does not exist!").Send()
+		if sub == "TARGETS" {
+			if len(args) != 2 {
+				i.FailHistory("INVALID_PARAMS", "Invalid parameters", sub)
+				return
+			}
+			from, errFrom := time.Parse(SERVER_TIME_FORMAT, strings.TrimPrefix(args[0], "timestamp="))
+			to, errTo := time.Parse(SERVER_TIME_FORMAT, strings.TrimPrefix(args[1], "timestamp="))
+			if errFrom != nil || errTo != nil {
+				i.FailHistory("INVALID_PARAMS", "Invalid timestamp", sub)
+				return
+			}
+			i.SendHistoryTargets(from, to, limit)
 			return
 		}
 
-		// TODO: sanatize the messsage
-		cl.Resp(CLIENT_PRIVMSG).Set(i.Nick).SetF(":%s", m.Values[1]).Send()
+		// BETWEEN is the only subcommand with two references
+		refs := 1
+		switch sub {
+		case "LATEST", "BEFORE", "AFTER", "AROUND":
+		case "BETWEEN":
+			refs = 2
+		default:
+			i.FailHistory("INVALID_PARAMS", "Unknown subcommand", sub)
+			return
+		}
+		if len(args) != refs+1 || args[0] == "" {
+			i.FailHistory("INVALID_PARAMS", "Invalid parameters", sub)
+			return
+		}
 
-	})
+		target := args[0]
+		key, err := i.HistoryTarget(target)
+		if err != nil {
+			i.FailHistory("INVALID_TARGET", err.Error(), sub, target)
+			return
+		}
 
-	PF("PART", func(i *Client, m *Msg) {
-		if len(m.Values) < 1 {
-			m.Error("PART requires 1 or more values!")
+		entries, ok := SelectHistory(i.Server.GetHistory(key), sub, args[1:], limit)
+		if !ok {
+			i.FailHistory("INVALID_PARAMS", "Invalid message reference", sub)
 			return
 		}
 
+		// Nothing new is kept with someone who isn't logged in, which
+		//  would otherwise look like they never replied
+		if cl := i.Server.FindUserByNick(target); cl != nil && cl.Account == "" {
+			i.Note(CLIENT_CHATHISTORY, "ACCOUNT_REQUIRED", target).Also(CAP_CHATHISTORY).
+				SendF("%s is not logged in, direct messages with them are not kept", cl.Nick)
+		}
+		i.SendHistory(target, entries)
+	}).Params(4, 5)
+
+	PF("PART", func(i *Client, m *Msg) {
 		// If the channel doesn't exist, the user cant part
 		if !i.Server.HasChannel(m.Values[0]) {
 			m.Error("Cannot PART from channel user is not in!")
@@ -295,11 +654,42 @@ func InitParser() {
 				Set(":Cannot PART from a channel you are not in!").
 				Send()
 		}
-	})
+	}).Params(1, 2)
 
 	PF("MODE", func(i *Client, m *Msg) {
-		if len(m.Values) < 2 {
-			m.Error("MODE requries 2 or more values!")
+		// Case: Is the user itself
+		if i.Server.Fold(m.Values[0]) == i.Server.Fold(i.Nick) {
+			// No modestring is a query
+			if len(m.Values) < 2 {
+				i.Resp(RPL_UMODEIS).SetF("+%s", i.Mode.Modes).Send()
+				return
+			}
+
+			// Modestrings have to say whether they add or remove modes
+			if !validModeString(m.Values[1]) {
+				i.Resp(ERR_UMODEUNKNOWNFLAG).Set(":Unknown MODE flag").Send()
+				return
+			}
+
+			prefix := string(m.Values[1][0])
+			changed := ""
+			for _, char := range m.Values[1][1:] {
+				if !strings.ContainsRune(USER_MODES_SETTABLE, char) {
+					continue
+				}
+
+				if prefix == "+" && !i.Mode.HasMode(string(char)) {
+					i.Mode.AddMode(string(char))
+					changed += string(char)
+				} else if prefix == "-" && i.Mode.HasMode(string(char)) {
+					i.Mode.RmvMode(string(char))
+					changed += string(char)
+				}
+			}
+
+			if changed != "" {
+				i.Cmd(CLIENT_MODE).Set(i.Nick).SetF(":%s%s", prefix, changed).Send()
+			}
 			return
 		}
 
@@ -307,18 +697,36 @@ func InitParser() {
 		if i.Server.HasChannel(m.Values[0]) {
 			ch := i.Server.GetChannel(m.Values[0])
 
+			// No modestring is a query, the key is only shown to members
+			if len(m.Values) < 2 {
+				r := i.Resp(RPL_CHANNELMODEIS).Set(ch.GetName()).SetF("+%s", ch.Mode.Modes)
+				if ch.Key != "" && ch.IsMember(i) {
+					r.Set(ch.Key)
+				}
+				r.Send()
+				return
+			}
+
 			if !ch.IsMember(i) {
 				i.Resp(ERR_NOTONCHANNEL).
 					Set(m.Values[0]).
 					Set(":You must be a member of the channel to set it's mode!").
 					Send()
+				return
 			}
 
-			if !ch.GetModes(i).Op || i.GlobalOp {
+			// Opers may change modes without being channel ops
+			if !ch.GetModes(i).Op && !i.GlobalOp {
 				i.Resp(ERR_CHANOPRIVSNEEDED).
 					Set(m.Values[0]).
 					Set(":You need OP to modify a channels mode!").
 					Send()
+				return
+			}
+
+			if !validModeString(m.Values[1]) || (len(m.Values) > 2 && len(m.Values[1]) < 2) {
+				i.Resp(ERR_UNKNOWNMODE).Set(m.Values[1]).Set(":is unknown mode char to me").Send()
+				return
 			}
 
 			prefix := string(m.Values[1][0])
@@ -333,7 +741,7 @@ func InitParser() {
 					}
 				}
 			} else {
-				if string(m.Values[1][1]) == "k" {
+				if string(m.Values[1][1]) == CHAN_MODE_KEY {
 					if prefix == "+" {
 						ch.Key = m.Values[2]
 					} else {
@@ -343,23 +751,206 @@ func InitParser() {
 			}
 			return
 		}
-	})
+	}).Params(1, -1)
 
-	PF("OPER", func(i *Client, m *Msg) {})
+	PF("OPER", func(i *Client, m *Msg) {
+		i.Oper(m.Values[0], m.Values[1])
+	}).Params(2, 2)
 
-	PF("TOPIC", func(i *Client, m *Msg) {})
+	PF("TOPIC", func(i *Client, m *Msg) {}).Params(1, 2)
 
 	// List users on server
-	PF("NAMES", func(i *Client, m *Msg) {})
+	PF("NAMES", func(i *Client, m *Msg) {}).Params(0, 2)
 
 	// List Channels on server
-	PF("LIST", func(i *Client, m *Msg) {})
-
-	PF("INVITE", func(i *Client, m *Msg) {})
-	PF("KICK", func(i *Client, m *Msg) {})
-	PF("VERSION", func(i *Client, m *Msg) {})
-	PF("STATS", func(i *Client, m *Msg) {})
-	PF("TIME", func(i *Client, m *Msg) {})
-	PF("INFO", func(i *Client, m *Msg) {})
-	PF("WHOIS", func(i *Client, m *Msg) {})
+	PF("LIST", func(i *Client, m *Msg) {}).Params(0, 2)
+
+	PF("INVITE", func(i *Client, m *Msg) {}).Params(2, 2)
+	PF("KICK", func(i *Client, m *Msg) {}).Params(2, 3)
+	PF("REHASH", func(i *Client, m *Msg) {
+		if !i.GlobalOp {
+			i.Resp(ERR_NOPRIVILEGES).Set(":Permission Denied- You're not an IRC operator").Send()
+			return
+		}
+
+		// There is no config file, so only the derived state is rebuilt
+		i.Resp(RPL_REHASHING).Set("*").Set(":Rehashing").Send()
+		i.Server.Rehash()
+	}).Params(0, 0)
+
+	PF("STATS", func(i *Client, m *Msg) {
+		if m.Values[0] == "" {
+			i.Resp(ERR_NEEDMOREPARAMS).Set("STATS").Set(":Not enough parameters").Send()
+			return
+		}
+
+		if len(m.Values) > 1 && !i.Server.IsLocal(m.Values[1]) {
+			i.Resp(ERR_NOSUCHSERVER).Set(m.Values[1]).Set(":No such server").Send()
+			return
+		}
+		i.SendStats(m.Values[0][:1])
+	}).Params(1, 2)
+
+	// Informational commands, all of which take an optional server mask as
+	//  their first value. We are the only server, so it has to match us
+	info := func(name string, f ParserF) {
+		PF(name, func(i *Client, m *Msg) {
+			if len(m.Values) > 0 && m.Values[0] != "" && !i.Server.IsLocal(m.Values[0]) {
+				i.Resp(ERR_NOSUCHSERVER).Set(m.Values[0]).Set(":No such server").Send()
+				return
+			}
+			f(i, m)
+		}).Params(0, 1)
+	}
+
+	info("VERSION", func(i *Client, m *Msg) {
+		i.SendVersion()
+	})
+
+	info("TIME", func(i *Client, m *Msg) {
+		i.Resp(RPL_TIME).Set(i.Server.GetHash()).SetF(":%s", time.Now().Format(time.RFC1123)).Send()
+	})
+
+	info("INFO", func(i *Client, m *Msg) {
+		i.SendInfo()
+	})
+
+	info("ADMIN", func(i *Client, m *Msg) {
+		i.SendAdmin()
+	})
+
+	info("MOTD", func(i *Client, m *Msg) {
+		i.SendMOTD()
+	})
+
+	// LUSERS takes a mask before the server, which we ignore
+	PF("LUSERS", func(i *Client, m *Msg) {
+		if len(m.Values) > 1 && !i.Server.IsLocal(m.Values[1]) {
+			i.Resp(ERR_NOSUCHSERVER).Set(m.Values[1]).Set(":No such server").Send()
+			return
+		}
+		i.SendLusers()
+	}).Params(0, 2)
+	PF("WHO", func(i *Client, m *Msg) {
+		// No mask (or `0`) lists everyone we can see
+		mask := "*"
+		if len(m.Values) > 0 && m.Values[0] != "0" && m.Values[0] != "" {
+			mask = m.Values[0]
+		}
+
+		// The second value holds the `o` flag and/or a WHOX field selector in
+		//  the form `%fields[,token]`
+		var opers bool = false
+		var fields, token string
+		if len(m.Values) > 1 {
+			opts := m.Values[1]
+			if idx := strings.Index(opts, "%"); idx != -1 {
+				fields = opts[idx+1:]
+				opts = opts[:idx]
+				if idx = strings.Index(fields, ","); idx != -1 {
+					fields, token = fields[:idx], fields[idx+1:]
+				}
+				// Clients expect a reply in the WHOX format even if they picked
+				//  no (known) fields
+				if fields == "" {
+					fields = "n"
+				}
+			}
+			opers = strings.Contains(opts, "o")
+		}
+
+		if i.Server.HasChannel(mask) {
+			ch := i.Server.GetChannel(mask)
+
+			// Secret channels are only listed to their members, and invisible
+			//  members are only listed to people on the channel
+			member := ch.IsMember(i)
+			if member || !ch.Mode.HasMode(CHAN_MODE_SECRET) {
+				for _, v := range ch.MemberList() {
+					if (opers && !v.GlobalOp) || (!member && !i.CanSee(v)) {
+						continue
+					}
+					i.SendWhoReply(v, ch, fields, token)
+				}
+			}
+		} else {
+			for _, v := range i.Server.ClientList() {
+				if v.State != STATE_ACTIVE || (opers && !v.GlobalOp) || !i.CanSee(v) {
+					continue
+				}
+
+				if i.Server.Match(mask, v.Nick) || i.Server.Match(mask, v.User) || i.Server.Match(mask, v.GetHost()) ||
+					i.Server.Match(mask, v.RealName) || i.Server.Match(mask, i.Server.GetHash()) {
+					i.SendWhoReply(v, nil, fields, token)
+				}
+			}
+		}
+
+		i.Resp(RPL_ENDOFWHO).Set(mask).Set(":End of /WHO list.").Send()
+	}).Params(0, 2)
+
+	PF("WHOWAS", func(i *Client, m *Msg) {
+		if len(m.Values) < 1 || m.Values[0] == "" {
+			i.Resp(ERR_NONICKNAMEGIVEN).Set(":No nickname given").Send()
+			return
+		}
+
+		// Optional max number of entries (per nick) to return
+		var count int = 0
+		if len(m.Values) > 1 {
+			count, _ = strconv.Atoi(m.Values[1])
+		}
+
+		for _, nick := range strings.Split(m.Values[0], ",") {
+			if nick == "" {
+				continue
+			}
+
+			entries := i.Server.WhoWas.Find(i.Server.Fold(nick), count)
+			if len(entries) == 0 {
+				i.Resp(ERR_WASNOSUCHNICK).Set(nick).Set(":There was no such nickname").Send()
+				continue
+			}
+
+			for _, e := range entries {
+				i.Resp(RPL_WHOWASUSER).Set(e.Nick).Set(e.User).Set(e.Host).Set("*").SetF(":%s", e.RealName).Send()
+				i.Resp(RPL_WHOISSERVER).Set(e.Nick).Set(e.Server).SetF(":%s", e.Time.UTC().Format(time.RFC1123)).Send()
+			}
+		}
+
+		i.Resp(RPL_ENDOFWHOWAS).Set(m.Values[0]).Set(":End of WHOWAS").Send()
+	}).Params(0, 3)
+
+	PF("WHOIS", func(i *Client, m *Msg) {
+		if len(m.Values) < 1 {
+			i.Resp(ERR_NONICKNAMEGIVEN).Set(":No nickname given").Send()
+			return
+		}
+
+		// Remote form (WHOIS <server|nick> <nicks>), we are the only server so
+		//  the first value must either be us or a nick that is on us
+		masks := m.Values[0]
+		if len(m.Values) > 1 {
+			if m.Values[0] != i.Server.GetHash() && i.Server.FindUserByNick(m.Values[0]) == nil {
+				i.Resp(ERR_NOSUCHSERVER).Set(m.Values[0]).Set(":No such server").Send()
+				return
+			}
+			masks = m.Values[1]
+		}
+
+		for _, nick := range strings.Split(masks, ",") {
+			if nick == "" {
+				continue
+			}
+
+			cl := i.Server.FindUserByNick(nick)
+			if cl == nil {
+				i.Resp(ERR_NOSUCHNICK).Set(nick).Set(":No such nick/channel").Send()
+				continue
+			}
+			i.SendWhois(cl)
+		}
+
+		i.Resp(RPL_ENDOFWHOIS).Set(masks).Set(":End of /WHOIS list.").Send()
+	}).Params(0, 2)
 }
@@ -0,0 +1,203 @@
+package gircd
+
+import "strings"
+import "testing"
+
+func TestUserModeBadModestring(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+
+	for _, line := range []string{"MODE alice :", "MODE alice i"} {
+		testSend(alice, line)
+		if got := conn.Lines(); !hasLine(got, " 501 alice ") {
+			t.Errorf("%q: got %q, want ERR_UMODEUNKNOWNFLAG", line, got)
+		}
+	}
+	if alice.Mode.HasMode(USER_MODE_INVISIBLE) {
+		t.Errorf("bad modestring set a mode")
+	}
+}
+
+func TestChannelModeBadModestring(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+	testSend(alice, "JOIN #x")
+	conn.Lines()
+
+	for _, line := range []string{"MODE #x :", "MODE #x k key"} {
+		testSend(alice, line)
+		if got := conn.Lines(); !hasLine(got, " 472 alice ") {
+			t.Errorf("%q: got %q, want ERR_UNKNOWNMODE", line, got)
+		}
+	}
+}
+
+func TestChannelModeNeedsOp(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	bob, conn := newTestClient(s, "bob")
+	testSend(alice, "JOIN #x")
+	testSend(bob, "JOIN #x")
+	conn.Lines()
+
+	testSend(bob, "MODE #x +k secret")
+	if got := conn.Lines(); !hasLine(got, " 482 bob ") {
+		t.Errorf("got %q, want ERR_CHANOPRIVSNEEDED", got)
+	}
+	if ch := s.GetChannel("#x"); ch.Key != "" {
+		t.Errorf("non-op set the key to %q", ch.Key)
+	}
+}
+
+func TestInvisibleHidden(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	bob, conn := newTestClient(s, "bob")
+	testSend(alice, "MODE alice +i")
+
+	if bob.GlobalOp {
+		t.Fatalf("new clients should not be opers")
+	}
+
+	testSend(bob, "WHO alice")
+	if got := conn.Lines(); hasLine(got, " 352 ") {
+		t.Errorf("invisible user listed to a stranger: %q", got)
+	}
+
+	testSend(alice, "JOIN #x")
+	testSend(bob, "JOIN #x")
+	conn.Lines()
+	testSend(bob, "WHO alice")
+	if got := conn.Lines(); !hasLine(got, " 352 bob ") {
+		t.Errorf("invisible user hidden from a channel peer: %q", got)
+	}
+}
+
+func TestNickErroneous(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+
+	for _, nick := range []string{"9bob", "bob!"} {
+		testSend(alice, "NICK "+nick)
+		if got := conn.Lines(); !hasLine(got, " 432 alice "+nick+" ") {
+			t.Errorf("NICK %s: got %q, want ERR_ERRONEUSNICKNAME", nick, got)
+		}
+		if alice.Nick != "alice" {
+			t.Errorf("NICK %s: nick changed to %q", nick, alice.Nick)
+		}
+	}
+}
+
+func TestMessageMultipleTargets(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+	_, bobConn := newTestClient(s, "bob")
+	_, carolConn := newTestClient(s, "carol")
+
+	testSend(alice, "PRIVMSG bob,carol,nobody :hi")
+	for name, c := range map[string]*testConn{"bob": bobConn, "carol": carolConn} {
+		want := ":alice!alice@10.0.0.1 PRIVMSG " + name + " :hi"
+		if got := c.Lines(); len(got) != 1 || got[0] != want {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+	if got := conn.Lines(); !hasLine(got, " 401 alice nobody ") {
+		t.Errorf("got %q, want ERR_NOSUCHNICK for nobody", got)
+	}
+
+	testSend(alice, "PRIVMSG bob,carol,bob,carol,bob :hi")
+	if got := conn.Lines(); !hasLine(got, " 407 alice ") {
+		t.Errorf("got %q, want ERR_TOOMANYTARGETS", got)
+	}
+	if got := bobConn.Lines(); len(got) != 0 {
+		t.Errorf("bob got %q past MAXTARGETS", got)
+	}
+}
+
+func TestJoinValidation(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+	bob, _ := newTestClient(s, "bob")
+	newTestChannel(s, "#locked", bob).Key = "key"
+
+	tests := []struct {
+		Line string
+		Want []string
+	}{
+		{"JOIN foo", []string{":irc.test 403 alice foo :No such channel"}},
+		{"JOIN #", []string{":irc.test 476 alice # :Bad Channel Mask"}},
+		{"JOIN #" + strings.Repeat("x", s.ChannelLen), []string{" 476 alice #xxx"}},
+		{"JOIN #a,foo,#b", []string{
+			":alice!alice@10.0.0.1 JOIN #a",
+			" 403 alice foo ",
+			":alice!alice@10.0.0.1 JOIN #b",
+		}},
+		{"JOIN #locked wrong", []string{" 475 alice #locked "}},
+		{"JOIN #c,#locked x,key", []string{
+			":alice!alice@10.0.0.1 JOIN #c",
+			":alice!alice@10.0.0.1 JOIN #locked",
+		}},
+	}
+
+	for _, v := range tests {
+		testSend(alice, v.Line)
+		got := conn.Lines()
+		for _, want := range v.Want {
+			if !hasLine(got, want) {
+				t.Errorf("%q: got %q, want %q", v.Line, got, want)
+			}
+		}
+	}
+
+	// Joining a channel again is ignored
+	testSend(alice, "JOIN #a")
+	if got := conn.Lines(); len(got) != 0 {
+		t.Errorf("JOIN #a again: got %q", got)
+	}
+
+	if n := alice.ChannelCount(); n != 4 {
+		t.Errorf("on %d channels, want 4", n)
+	}
+
+	// JOIN 0 parts everything
+	testSend(alice, "JOIN 0")
+	got := conn.Lines()
+	for _, name := range []string{"#a", "#b", "#c", "#locked"} {
+		if !hasLine(got, ":alice!alice@10.0.0.1 PART "+name) {
+			t.Errorf("JOIN 0: got %q, want a PART for %s", got, name)
+		}
+	}
+	if n := alice.ChannelCount(); n != 0 {
+		t.Errorf("on %d channels after JOIN 0", n)
+	}
+}
+
+func TestDispatchNumerics(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice")
+	unregistered, unregisteredConn := newUnregisteredClient(s)
+
+	tests := []struct {
+		Client *Client
+		Conn   *testConn
+		Line   string
+		Want   string
+	}{
+		{alice, conn, "FOO bar", ":irc.test 421 alice FOO :Unknown command"},
+		{unregistered, unregisteredConn, "JOIN #x", ":irc.test 451 * :You have not registered"},
+		{alice, conn, "JOIN", ":irc.test 461 alice JOIN :Not enough parameters"},
+		{alice, conn, "USER a 0 * :A", ":irc.test 462 alice :You may not reregister"},
+		{alice, conn, "PASS secret", ":irc.test 462 alice :You may not reregister"},
+	}
+
+	for _, v := range tests {
+		testSend(v.Client, v.Line)
+		if got := v.Conn.Lines(); len(got) != 1 || got[0] != v.Want {
+			t.Errorf("%q: got %q, want %q", v.Line, got, v.Want)
+		}
+	}
+
+	if unregistered.ChannelCount() != 0 {
+		t.Errorf("unregistered client joined a channel")
+	}
+}
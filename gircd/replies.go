@@ -0,0 +1,84 @@
+package gircd
+
+import "fmt"
+
+// A standard reply (`FAIL/WARN/NOTE <command> <code> [context...] :desc`),
+// used for failures and notes that have no numeric of their own. Clients
+// without standard-replies get the description as a NOTICE instead
+type StandardReply struct {
+	Type    string
+	Command string
+	Code    string
+	Context []string
+	Client  *Client
+
+	// Clients with this capability get the reply as-is too, for specs that
+	//  require standard replies (e.g. draft/chathistory)
+	Cap string
+}
+
+// Creates a FAIL reply to `command`, which failed as a whole
+func (c *Client) Fail(command string, code string, context ...string) *StandardReply {
+	return c.standardReply(CLIENT_FAIL, command, code, context)
+}
+
+// Creates a WARN reply to `command`, which went through but something was off
+func (c *Client) Warn(command string, code string, context ...string) *StandardReply {
+	return c.standardReply(CLIENT_WARN, command, code, context)
+}
+
+// Creates a NOTE reply to `command`, which is purely informational
+func (c *Client) Note(command string, code string, context ...string) *StandardReply {
+	return c.standardReply(CLIENT_NOTE, command, code, context)
+}
+
+func (c *Client) standardReply(typ string, command string, code string, context []string) *StandardReply {
+	// Replies that aren't about a single command use `*`
+	if command == "" {
+		command = "*"
+	}
+	return &StandardReply{
+		Type:    typ,
+		Command: command,
+		Code:    code,
+		Context: context,
+		Client:  c,
+	}
+}
+
+// Also sends the reply as-is to clients with capability `name`
+func (r *StandardReply) Also(name string) *StandardReply {
+	r.Cap = name
+	return r
+}
+
+// Sends the reply with a human readable description
+func (r *StandardReply) Send(desc string) {
+	c := r.Client
+	if !c.HasCap(CAP_STANDARD_REPLIES) && (r.Cap == "" || !c.HasCap(r.Cap)) {
+		if r.Command == "*" {
+			c.Notice(desc).Send()
+		} else {
+			c.Notice(fmt.Sprintf("%s: %s", r.Command, desc)).Send()
+		}
+		return
+	}
+
+	resp := c.ServerCmd(r.Type).Set(r.Command).Set(r.Code)
+	for _, v := range r.Context {
+		resp.Set(v)
+	}
+	resp.SetF(":%s", desc).Send()
+}
+
+// Formats and sends the description
+func (r *StandardReply) SendF(desc string, vals ...interface{}) {
+	r.Send(fmt.Sprintf(desc, vals...))
+}
+
+// Logs a failure of the message like Error, and lets the client know with a
+// FAIL reply
+func (m *Msg) Fail(code string, desc string, context ...string) {
+	m.Error(desc)
+	m.Client.Fail(m.Tag, code, context...).Send(desc)
+}
@@ -0,0 +1,86 @@
+package gircd
+
+import "strings"
+import "testing"
+
+func TestStandardReplies(t *testing.T) {
+	s := newTestServer()
+	plain, _ := newTestClient(s, "plain")
+	std, _ := newTestClient(s, "std", CAP_STANDARD_REPLIES)
+	hist, _ := newTestClient(s, "hist", CAP_CHATHISTORY)
+
+	tests := []struct {
+		Name  string
+		Reply *StandardReply
+		Want  string
+	}{
+		{"fail", std.Fail("JOIN", "X", "#a"),
+			":irc.test FAIL JOIN X #a :went wrong"},
+		{"fail without standard-replies", plain.Fail("JOIN", "X", "#a"),
+			":irc.test NOTICE plain :JOIN: went wrong"},
+		{"warn", std.Warn("AWAY", "X"),
+			":irc.test WARN AWAY X :went wrong"},
+		{"note about no command", std.Note("", "X"),
+			":irc.test NOTE * X :went wrong"},
+		{"note about no command without standard-replies", plain.Note("", "X"),
+			":irc.test NOTICE plain :went wrong"},
+		{"also with the capability", hist.Fail("CHATHISTORY", "X").Also(CAP_CHATHISTORY),
+			":irc.test FAIL CHATHISTORY X :went wrong"},
+		{"also without the capability", plain.Fail("CHATHISTORY", "X").Also(CAP_CHATHISTORY),
+			":irc.test NOTICE plain :CHATHISTORY: went wrong"},
+	}
+
+	for _, v := range tests {
+		v.Reply.Send("went wrong")
+		if got := v.Reply.Client.Conn.(*testConn).Lines(); len(got) != 1 || got[0] != v.Want {
+			t.Errorf("%s: got %q, want %q", v.Name, got, v.Want)
+		}
+	}
+}
+
+func TestAwayTruncatedWarn(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_STANDARD_REPLIES)
+
+	testSend(alice, "AWAY :"+strings.Repeat("x", s.AwayLen+1))
+	if got := conn.Lines(); !hasLine(got, ":irc.test WARN AWAY MESSAGE_TRUNCATED :") {
+		t.Errorf("got %q, want MESSAGE_TRUNCATED", got)
+	}
+	if len(alice.Away) != s.AwayLen {
+		t.Errorf("away message is %d long, want %d", len(alice.Away), s.AwayLen)
+	}
+
+	testSend(alice, "AWAY :lunch")
+	if got := conn.Lines(); hasLine(got, " WARN ") {
+		t.Errorf("short message: got %q", got)
+	}
+}
+
+func TestRateLimitFail(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_STANDARD_REPLIES)
+	plain, plainConn := newTestClient(s, "plain")
+
+	alice.Messages = MESSAGES_PER_5_SEC
+	alice.CheckRateLimit()
+	if got := conn.Lines(); len(got) != 0 || alice.State == STATE_DEAD {
+		t.Errorf("at the limit: got %q", got)
+	}
+
+	alice.Messages = MESSAGES_PER_5_SEC + 1
+	plain.Messages = MESSAGES_PER_5_SEC + 1
+	alice.CheckRateLimit()
+	plain.CheckRateLimit()
+
+	got := conn.Lines()
+	if len(got) != 2 || got[0] != ":irc.test FAIL * RATE_LIMITED :You are sending messages too fast" ||
+		got[1] != ":irc.test ERROR :Closing Link: 10.0.0.1 (Rate Limiting)" {
+		t.Errorf("over the limit: got %q, want RATE_LIMITED and ERROR", got)
+	}
+	if got := plainConn.Lines(); !hasLine(got, ":irc.test NOTICE plain :You are sending messages too fast") {
+		t.Errorf("without standard-replies: got %q, want a NOTICE", got)
+	}
+	if alice.State != STATE_DEAD || plain.State != STATE_DEAD {
+		t.Errorf("clients over the limit were not disconnected")
+	}
+}
@@ -8,63 +8,217 @@ const (
 )
 
 const (
-	RPL_WELCOME      = "001"
-	RPL_YOURHOST     = "002"
-	RPL_CREATED      = "003"
-	RPL_MYINFO       = "004"
-	RPL_TOPIC        = "332"
-	RPL_TOPICWHOTIME = "333"
-	RPL_NAMREPLY     = "353"
-	RPL_ENDOFNAMES   = "366"
-	RPL_MOTDSTART    = "375"
-	RPL_MOTD         = "372"
-	RPL_ENDOFMOTD    = "376"
+	RPL_WELCOME       = "001"
+	RPL_YOURHOST      = "002"
+	RPL_CREATED       = "003"
+	RPL_MYINFO        = "004"
+	RPL_ISUPPORT      = "005"
+	RPL_STATSLINKINFO = "211"
+	RPL_STATSCOMMANDS = "212"
+	RPL_STATSKLINE    = "216"
+	RPL_STATSYLINE    = "218"
+	RPL_ENDOFSTATS    = "219"
+	RPL_UMODEIS       = "221"
+	RPL_STATSUPTIME   = "242"
+	RPL_STATSOLINE    = "243"
+	RPL_LUSERCLIENT   = "251"
+	RPL_LUSEROP       = "252"
+	RPL_LUSERUNKNOWN  = "253"
+	RPL_LUSERCHANNELS = "254"
+	RPL_LUSERME       = "255"
+	RPL_ADMINME       = "256"
+	RPL_ADMINLOC1     = "257"
+	RPL_ADMINLOC2     = "258"
+	RPL_ADMINEMAIL    = "259"
+	RPL_LOCALUSERS    = "265"
+	RPL_GLOBALUSERS   = "266"
+	RPL_AWAY          = "301"
+	RPL_UNAWAY        = "305"
+	RPL_NOWAWAY       = "306"
+	RPL_WHOISUSER     = "311"
+	RPL_WHOISSERVER   = "312"
+	RPL_WHOISOPERATOR = "313"
+	RPL_WHOWASUSER    = "314"
+	RPL_ENDOFWHO      = "315"
+	RPL_WHOISIDLE     = "317"
+	RPL_ENDOFWHOIS    = "318"
+	RPL_WHOISCHANNELS = "319"
+	RPL_CHANNELMODEIS = "324"
+	RPL_WHOISACCOUNT  = "330"
+	RPL_TOPIC         = "332"
+	RPL_TOPICWHOTIME  = "333"
+	RPL_VERSION       = "351"
+	RPL_WHOREPLY      = "352"
+	RPL_WHOSPCRPL     = "354"
+	RPL_NAMREPLY      = "353"
+	RPL_ENDOFNAMES    = "366"
+	RPL_ENDOFWHOWAS   = "369"
+	RPL_INFO          = "371"
+	RPL_ENDOFINFO     = "374"
+	RPL_MOTDSTART     = "375"
+	RPL_MOTD          = "372"
+	RPL_ENDOFMOTD     = "376"
+	RPL_YOUREOPER     = "381"
+	RPL_REHASHING     = "382"
+	RPL_TIME          = "391"
+	RPL_VISIBLEHOST   = "396"
+	RPL_WHOISSECURE   = "671"
+	RPL_LOGGEDIN      = "900"
+	RPL_LOGGEDOUT     = "901"
+	RPL_SASLSUCCESS   = "903"
+	RPL_SASLMECHS     = "908"
 
 	// Clients
-	CLIENT_JOIN    = "JOIN"
-	CLIENT_PART    = "PART"
-	CLIENT_PING    = "PING"
-	CLIENT_PONG    = "PONG"
-	CLIENT_PRIVMSG = "PRIVMSG"
+	CLIENT_JOIN         = "JOIN"
+	CLIENT_ACK          = "ACK"
+	CLIENT_ACCOUNT      = "ACCOUNT"
+	CLIENT_AWAY         = "AWAY"
+	CLIENT_AUTHENTICATE = "AUTHENTICATE"
+	CLIENT_BATCH        = "BATCH"
+	CLIENT_CAP          = "CAP"
+	CLIENT_CHGHOST      = "CHGHOST"
+	CLIENT_CHATHISTORY  = "CHATHISTORY"
+	CLIENT_ERROR        = "ERROR"
+	CLIENT_FAIL         = "FAIL"
+	CLIENT_WARN         = "WARN"
+	CLIENT_NOTE         = "NOTE"
+	CLIENT_MODE         = "MODE"
+	CLIENT_NICK         = "NICK"
+	CLIENT_PART         = "PART"
+	CLIENT_PING         = "PING"
+	CLIENT_PONG         = "PONG"
+	CLIENT_PRIVMSG      = "PRIVMSG"
+	CLIENT_NOTICE       = "NOTICE"
+	CLIENT_QUIT         = "QUIT"
+	CLIENT_SETNAME      = "SETNAME"
+	CLIENT_TAGMSG       = "TAGMSG"
 
 	// Errors
 	ERR_UNKNOWNERROR     = "400"
+	ERR_INVALIDCAPCMD    = "410"
+	ERR_NOSUCHNICK       = "401"
+	ERR_NOSUCHSERVER     = "402"
 	ERR_NOSUCHCHANNEL    = "403"
 	ERR_TOOMANYCHANNELS  = "405"
 	ERR_CANNOTSENDTOCHAN = "404"
+	ERR_WASNOSUCHNICK    = "406"
+	ERR_TOOMANYTARGETS   = "407"
 	ERR_NORECIPIENT      = "411"
+	ERR_NOMOTD           = "422"
+	ERR_NOADMININFO      = "423"
+	ERR_NOTEXTTOSEND     = "412"
+	ERR_INPUTTOOLONG     = "417"
+	ERR_UNKNOWNCOMMAND   = "421"
+	ERR_NONICKNAMEGIVEN  = "431"
 	ERR_ERRONEUSNICKNAME = "432"
 	ERR_NICKNAMEINUSE    = "433"
+	ERR_UNAVAILRESOURCE  = "437"
+	ERR_NICKTOOFAST      = "438"
 	ERR_NOTONCHANNEL     = "442"
+	ERR_NOTREGISTERED    = "451"
+	ERR_NEEDMOREPARAMS   = "461"
+	ERR_ALREADYREGISTRED = "462"
+	ERR_PASSWDMISMATCH   = "464"
+	ERR_YOUREBANNEDCREEP = "465"
 	ERR_CHANNELISFULL    = "471"
+	ERR_UNKNOWNMODE      = "472"
 	ERR_BADCHANNELKEY    = "475"
+	ERR_BADCHANMASK      = "476"
+	ERR_NOPRIVILEGES     = "481"
 	ERR_CHANOPRIVSNEEDED = "482"
+	ERR_NOOPERHOST       = "491"
+	ERR_UMODEUNKNOWNFLAG = "501"
 	ERR_BADPING          = "513"
+	ERR_SASLFAIL         = "904"
+	ERR_SASLTOOLONG      = "905"
+	ERR_SASLABORTED      = "906"
+	ERR_SASLALREADY      = "907"
 )
 
+// ENUM: ResponseSource
 const (
-	CHAN_GLOBAL = iota
-	CHAN_USER
+	// `:server TAG target params`, used for numerics and server notices
+	SOURCE_NUMERIC = iota
+	// `:server TAG params`, used for commands the server itself sends (e.g. PONG)
+	SOURCE_SERVER
+	// `:nick!user@host TAG params`, used for commands relayed from a client
+	SOURCE_CLIENT
 )
 
 type Response struct {
-	Tag     string
-	Vars    []interface{}
-	Channel int
-	Server  *Server
-	Client  *Client
+	Tag    string
+	Vars   []interface{}
+	Source int
+	Server *Server
+
+	// For server-sourced responses this is the client the response is
+	//  addressed to, for SOURCE_CLIENT it is the client it originates from
+	Client *Client
+
+	// Hostmask of the originating client, captured when the command is
+	//  created so later nick changes or quits don't affect it
+	Prefix string
+
+	// Message tags, each recipient only gets the ones it negotiated
+	Tags map[string]string
+
+	// Capability a client needs to get the response at all (e.g. TAGMSG),
+	//  and a client that is skipped when sending to a channel
+	Cap     string
+	Exclude *Client
+
+	// Other forms of the response for clients with a capability (e.g. the
+	//  extended-join JOIN), see Variant
+	Variants []ResponseVariant
+}
+
+// A form of a response sent to clients with capability Cap
+type ResponseVariant struct {
+	Cap      string
+	Response *Response
 }
 
+// Creates a numeric response addressed to `cl`
 func NewResponse(tg string, cl *Client, sl *Server) *Response {
 	return &Response{
-		Tag:     tg,
-		Vars:    make([]interface{}, 0),
-		Channel: CHAN_GLOBAL,
-		Server:  sl,
-		Client:  cl,
+		Tag:    tg,
+		Vars:   make([]interface{}, 0),
+		Source: SOURCE_NUMERIC,
+		Server: sl,
+		Client: cl,
+		Tags:   make(map[string]string),
+	}
+}
+
+// Creates a server-sourced command (e.g. PONG) sent to `cl`
+func NewServerCommand(tg string, cl *Client, sl *Server) *Response {
+	r := NewResponse(tg, cl, sl)
+	r.Source = SOURCE_SERVER
+	return r
+}
+
+// Creates a client-sourced command (e.g. PRIVMSG) sent on behalf of `cl`,
+// every one of these gets a msgid and the time it was created
+func NewCommand(tg string, cl *Client) *Response {
+	return &Response{
+		Tag:    tg,
+		Vars:   make([]interface{}, 0),
+		Source: SOURCE_CLIENT,
+		Server: cl.Server,
+		Client: cl,
+		Prefix: cl.GetHash(),
+		Tags: map[string]string{
+			TAG_MSGID: cl.Server.NewMsgID(),
+			TAG_TIME:  ServerTime(),
+		},
 	}
 }
 
+// Creates a server notice addressed to `cl`
+func NewNotice(cl *Client, sl *Server, text string) *Response {
+	return NewResponse(CLIENT_NOTICE, cl, sl).SetF(":%s", text)
+}
+
 func (r *Response) Set(v interface{}) *Response {
 	r.Vars = append(r.Vars, v)
 	return r
@@ -75,22 +229,130 @@ func (r *Response) SetF(s string, vals ...interface{}) *Response {
 	return r
 }
 
+// Sets tag `name` to `value`
+func (r *Response) SetTag(name string, value string) *Response {
+	r.Tags[name] = value
+	return r
+}
+
+// Sets every tag in `tags`
+func (r *Response) SetTags(tags map[string]string) *Response {
+	for k, v := range tags {
+		r.Tags[k] = v
+	}
+	return r
+}
+
+// Only sends the response to clients with capability `name`
+func (r *Response) RequireCap(name string) *Response {
+	r.Cap = name
+	return r
+}
+
+// Skips client `cl` when the response is sent to a channel
+func (r *Response) Except(cl *Client) *Response {
+	r.Exclude = cl
+	return r
+}
+
+// Sends `alt` instead of the response to clients with capability `name`,
+// the first variant that matches a client wins
+func (r *Response) Variant(name string, alt *Response) *Response {
+	r.Variants = append(r.Variants, ResponseVariant{name, alt})
+	return r
+}
+
+// Returns the form of the response client `cl` gets
+func (r *Response) For(cl *Client) *Response {
+	for _, v := range r.Variants {
+		if cl.HasCap(v.Cap) {
+			return v.Response
+		}
+	}
+	return r
+}
+
+// Returns a copy of the response (with the same tags) that can be changed
+// without affecting the original, variants are not copied
+func (r *Response) Copy() *Response {
+	res := *r
+	res.Vars = append(make([]interface{}, 0, len(r.Vars)), r.Vars...)
+	res.Tags = make(map[string]string, len(r.Tags))
+	for k, v := range r.Tags {
+		res.Tags[k] = v
+	}
+	res.Variants = nil
+	return &res
+}
+
+// Returns the target field of a numeric response, unregistered
+// clients have no nick yet and are addressed as `*`
+func (r *Response) Target() string {
+	if r.Client == nil || r.Client.Nick == "" {
+		return "*"
+	}
+	return r.Client.Nick
+}
+
 func (r *Response) Build() string {
-	base := fmt.Sprintf(strings.Repeat("%s ", len(r.Vars)), r.Vars...)
-	if r.Channel == CHAN_GLOBAL {
-		return fmt.Sprintf(":%s %s %s %s", r.Server.GetHash(), r.Tag, r.Client.Nick, base)
-	} else if r.Channel == CHAN_USER {
-		return fmt.Sprintf(":%s %s %s", r.Client.GetHash(), r.Tag, base)
+	parts := make([]string, 0, len(r.Vars)+3)
+	switch r.Source {
+	case SOURCE_NUMERIC:
+		parts = append(parts, ":"+r.Server.GetHash(), r.Tag, r.Target())
+	case SOURCE_SERVER:
+		parts = append(parts, ":"+r.Server.GetHash(), r.Tag)
+	case SOURCE_CLIENT:
+		parts = append(parts, ":"+r.Prefix, r.Tag)
 	}
-	return ""
+	for _, v := range r.Vars {
+		parts = append(parts, fmt.Sprint(v))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Returns the tags of the response client `cl` negotiated
+func (r *Response) TagsFor(cl *Client) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range r.Tags {
+		if cl.WantsTag(k) {
+			tags[k] = v
+		}
+	}
+	return tags
 }
 
+// Builds the response for client `cl`, with the tags it negotiated
+func (r *Response) BuildFor(cl *Client) string {
+	return formatLine(r.TagsFor(cl), r.Build())
+}
+
+// Prepends tags (if there are any) to a line
+func formatLine(tags map[string]string, line string) string {
+	if len(tags) == 0 {
+		return line
+	}
+	return "@" + FormatTags(tags) + " " + line
+}
+
+// Writes the response to r.Client
 func (r *Response) Send() {
-	r.Channel = CHAN_GLOBAL
-	r.Client.Write(r.Build())
+	r.SendTo(r.Client)
+}
+
+// Writes the response to client `cl`, unless it lacks the required capability.
+// Replies to a labeled command are held back until the command is done
+func (r *Response) SendTo(cl *Client) {
+	r = r.For(cl)
+	if r.Cap != "" && !cl.HasCap(r.Cap) {
+		return
+	}
+	if cl.captureLabeled(r) {
+		return
+	}
+	cl.Write(r.BuildFor(cl))
 }
 
+// Queues the response for every member of channel `c`
 func (r *Response) Chan(c *Channel) {
-	r.Channel = CHAN_USER
-	c.Send(r.Build())
+	c.Send(r)
 }
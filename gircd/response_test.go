@@ -0,0 +1,64 @@
+package gircd
+
+import "testing"
+
+func TestResponseBuild(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+
+	unregistered, _ := newUnregisteredClient(s)
+
+	tests := []struct {
+		Name string
+		Resp *Response
+		Want string
+	}{
+		{"numeric", alice.Resp(RPL_WELCOME).Set(":Welcome"),
+			":irc.test 001 alice :Welcome"},
+		{"numeric to unregistered", unregistered.Resp(ERR_NOTREGISTERED).Set(":You have not registered"),
+			":irc.test 451 * :You have not registered"},
+		{"server command", alice.ServerCmd(CLIENT_PONG).Set("irc.test").Set(":x"),
+			":irc.test PONG irc.test :x"},
+		{"client command", alice.Cmd(CLIENT_PRIVMSG).Set("bob").Set(":hi there"),
+			":alice!alice@10.0.0.1 PRIVMSG bob :hi there"},
+		{"notice", alice.Notice("Server restarting"),
+			":irc.test NOTICE alice :Server restarting"},
+	}
+
+	for _, v := range tests {
+		if got := v.Resp.Build(); got != v.Want {
+			t.Errorf("%s: got %q, want %q", v.Name, got, v.Want)
+		}
+	}
+}
+
+func TestResponseBuildFor(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	plain, _ := newTestClient(s, "plain")
+	timed, _ := newTestClient(s, "timed", CAP_SERVER_TIME)
+	tagged, _ := newTestClient(s, "tagged", CAP_MESSAGE_TAGS)
+
+	r := alice.Cmd(CLIENT_PRIVMSG).Set("#x").Set(":hi").SetTag("+typing", "active")
+	r.Tags[TAG_MSGID] = "abc"
+	r.Tags[TAG_TIME] = "2020-01-01T00:00:00.000Z"
+
+	tests := []struct {
+		Name   string
+		Client *Client
+		Want   string
+	}{
+		{"no caps", plain,
+			":alice!alice@10.0.0.1 PRIVMSG #x :hi"},
+		{"server-time", timed,
+			"@time=2020-01-01T00:00:00.000Z :alice!alice@10.0.0.1 PRIVMSG #x :hi"},
+		{"message-tags", tagged,
+			"@+typing=active;msgid=abc :alice!alice@10.0.0.1 PRIVMSG #x :hi"},
+	}
+
+	for _, v := range tests {
+		if got := r.BuildFor(v.Client); got != v.Want {
+			t.Errorf("%s: got %q, want %q", v.Name, got, v.Want)
+		}
+	}
+}
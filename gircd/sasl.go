@@ -0,0 +1,286 @@
+package gircd
+
+import "bytes"
+import "crypto/tls"
+import "encoding/base64"
+import "errors"
+import "strings"
+
+// Enum: SASL mechanisms
+const (
+	SASL_PLAIN    = "PLAIN"
+	SASL_EXTERNAL = "EXTERNAL"
+)
+
+// AUTHENTICATE payloads are sent in chunks of this many bytes, a chunk that
+// is exactly this long means more are coming
+const SASL_CHUNK_SIZE = 400
+
+// Most (base64 encoded) bytes a client may send in a single exchange
+const SASL_MAX_SIZE = 8192
+
+var ERR_SASL_INVALID = errors.New("invalid SASL message")
+var ERR_SASL_CREDENTIALS = errors.New("invalid credentials")
+
+// One exchange of a SASL mechanism. Step gets each (decoded) client response
+// and either returns the next challenge, or the account name once done
+type SASLMech interface {
+	Step(c *Client, data []byte) (challenge []byte, account string, err error)
+}
+
+// Creates a new exchange of a mechanism
+type SASLMechF func() SASLMech
+
+// Mechanisms offered in the `sasl` capability, in order of preference
+var SASL_MECHS = []string{SASL_SCRAM_SHA_256, SASL_PLAIN, SASL_EXTERNAL}
+
+// Create a map of mechanisms
+var SASL_MECH_FUNCS = map[string]SASLMechF{
+	SASL_PLAIN:         func() SASLMech { return &SASLPlain{} },
+	SASL_EXTERNAL:      func() SASLMech { return &SASLExternal{} },
+	SASL_SCRAM_SHA_256: func() SASLMech { return &SASLScram{} },
+}
+
+// An AUTHENTICATE exchange in progress
+type SASLSession struct {
+	Mech string
+	Impl SASLMech
+
+	// Chunks of the current client response received so far
+	Buffer string
+}
+
+// SASL PLAIN (RFC 4616), a single `authzid\0authcid\0password` response
+type SASLPlain struct{}
+
+func (m *SASLPlain) Step(c *Client, data []byte) ([]byte, string, error) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return nil, "", ERR_SASL_INVALID
+	}
+	authz, authc, pass := string(parts[0]), string(parts[1]), string(parts[2])
+
+	acc, ok := c.Server.Accounts.CheckPassword(authc, pass)
+	if !ok {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+
+	// We don't let anyone act as somebody else
+	if authz != "" && !strings.EqualFold(authz, acc) {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+	return nil, acc, nil
+}
+
+// SASL EXTERNAL (RFC 4422), the account is picked from the fingerprint of the
+// client's TLS certificate
+type SASLExternal struct{}
+
+func (m *SASLExternal) Step(c *Client, data []byte) ([]byte, string, error) {
+	fp := c.CertFP()
+	if fp == "" {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+
+	acc, ok := c.Server.Accounts.FindByCertFP(fp)
+	if !ok {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+
+	if len(data) > 0 && !strings.EqualFold(string(data), acc) {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+	return nil, acc, nil
+}
+
+// Returns the SHA-256 fingerprint of the client's TLS certificate, or an
+// empty string if it didn't send one
+func (c *Client) CertFP() string {
+	conn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return CertFP(certs[0].Raw)
+}
+
+// Sends a server challenge, base64 encoded and split into chunks
+func (c *Client) SendSASLChallenge(data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) >= SASL_CHUNK_SIZE {
+		c.ServerCmd(CLIENT_AUTHENTICATE).Set(enc[:SASL_CHUNK_SIZE]).Send()
+		enc = enc[SASL_CHUNK_SIZE:]
+	}
+
+	// An empty (or final full-size) chunk is sent as `+`
+	if enc == "" {
+		enc = "+"
+	}
+	c.ServerCmd(CLIENT_AUTHENTICATE).Set(enc).Send()
+}
+
+// Ends the current SASL exchange, if there is one
+func (c *Client) AbortSASL() {
+	if c.SASL == nil {
+		return
+	}
+	c.SASL = nil
+	c.Resp(ERR_SASLABORTED).Set(":SASL authentication aborted").Send()
+}
+
+// Ends the current SASL exchange as failed
+func (c *Client) FailSASL() {
+	c.SASL = nil
+	c.Resp(ERR_SASLFAIL).Set(":SASL authentication failed").Send()
+}
+
+// Changes the account the client is logged in to (empty for none), and lets
+// the clients sharing a channel with it know if they have account-notify
+func (c *Client) SetAccount(name string) {
+	c.Account = name
+
+	account := name
+	if account == "" {
+		account = "*"
+	}
+	c.Cmd(CLIENT_ACCOUNT).Set(account).RequireCap(CAP_ACCOUNT_NOTIFY).SendAll(c.Peers())
+}
+
+// Logs the client in to account `name`
+func (c *Client) Login(name string) {
+	c.SetAccount(name)
+
+	// Parts of the hostmask we don't know yet are sent as `*`
+	nick, user := c.Nick, c.User
+	if nick == "" {
+		nick = "*"
+	}
+	if user == "" {
+		user = "*"
+	}
+	c.Resp(RPL_LOGGEDIN).SetF("%s!%s@%s", nick, user, c.GetHost()).Set(name).
+		SetF(":You are now logged in as %s", name).Send()
+}
+
+// Logs the client out of its account, if it is logged in
+func (c *Client) Logout() {
+	if c.Account == "" {
+		return
+	}
+	c.SetAccount("")
+	c.Resp(RPL_LOGGEDOUT).Set(c.GetHash()).Set(":You are now logged out").Send()
+}
+
+// Removes account `name` from the account backend, and logs out the clients
+// using it. Returns false if the backend can't remove it
+func (s *Server) RemoveAccount(name string) bool {
+	remover, ok := s.Accounts.(AccountRemover)
+	if !ok || !remover.Remove(name) {
+		return false
+	}
+
+	for _, cl := range s.ClientList() {
+		if strings.EqualFold(cl.Account, name) {
+			cl.Logout()
+		}
+	}
+	return true
+}
+
+// Handles a single AUTHENTICATE message
+func (c *Client) Authenticate(data string) {
+	if data == "*" {
+		c.AbortSASL()
+		return
+	}
+
+	// The first message picks the mechanism
+	if c.SASL == nil {
+		mech := strings.ToUpper(data)
+		f, has := SASL_MECH_FUNCS[mech]
+		if !has || !c.Server.HasSASLMech(mech) {
+			c.Resp(RPL_SASLMECHS).Set(strings.Join(c.Server.SASLMechs(), ",")).
+				Set(":are available SASL mechanisms").Send()
+			c.FailSASL()
+			return
+		}
+
+		c.SASL = &SASLSession{Mech: mech, Impl: f()}
+		c.ServerCmd(CLIENT_AUTHENTICATE).Set("+").Send()
+		return
+	}
+
+	if len(data) > SASL_CHUNK_SIZE || len(c.SASL.Buffer)+len(data) > SASL_MAX_SIZE {
+		c.SASL = nil
+		c.Resp(ERR_SASLTOOLONG).Set(":SASL message too long").Send()
+		return
+	}
+
+	if data != "+" {
+		c.SASL.Buffer += data
+	}
+
+	// Wait for the rest of the response
+	if len(data) == SASL_CHUNK_SIZE {
+		return
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(c.SASL.Buffer)
+	c.SASL.Buffer = ""
+	if err != nil {
+		c.FailSASL()
+		return
+	}
+
+	challenge, account, err := c.SASL.Impl.Step(c, payload)
+	if err != nil {
+		c.LogF("SASL %s failed: %s\n", c.SASL.Mech, err)
+		c.FailSASL()
+		return
+	}
+
+	if account == "" {
+		c.SendSASLChallenge(challenge)
+		return
+	}
+
+	c.SASL = nil
+	c.Login(account)
+	c.Resp(RPL_SASLSUCCESS).Set(":SASL authentication successful").Send()
+}
+
+// Returns the mechanisms the server can offer, none without an account backend
+func (s *Server) SASLMechs() []string {
+	res := make([]string, 0)
+	if s.Accounts == nil {
+		return res
+	}
+
+	for _, v := range SASL_MECHS {
+		// EXTERNAL needs client certificates, which only come in over TLS
+		if v == SASL_EXTERNAL && s.TLSConfig == nil {
+			continue
+		}
+
+		// SCRAM needs the backend to keep salted credentials around
+		if _, ok := s.Accounts.(SCRAMBackend); v == SASL_SCRAM_SHA_256 && !ok {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// Returns true if mechanism `name` is offered
+func (s *Server) HasSASLMech(name string) bool {
+	for _, v := range s.SASLMechs() {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package gircd
+
+import "encoding/base64"
+import "testing"
+
+func TestAccountNotifyOnLogin(t *testing.T) {
+	s := newTestServer()
+	newTestAccounts(s, "bob:hunter2")
+
+	alice, aliceConn := newTestClient(s, "alice", CAP_ACCOUNT_NOTIFY)
+	carol, carolConn := newTestClient(s, "carol")
+	bob, bobConn := newTestClient(s, "bob", CAP_SASL)
+	newTestChannel(s, "#x", alice, carol, bob)
+
+	// Logging in after registration
+	testSend(bob, "AUTHENTICATE PLAIN")
+	testSend(bob, "AUTHENTICATE "+base64.StdEncoding.EncodeToString([]byte("\x00bob\x00hunter2")))
+	if got := bobConn.Lines(); !hasLine(got, " 903 bob ") {
+		t.Fatalf("got %q, want RPL_SASLSUCCESS", got)
+	}
+	if bob.Account != "bob" {
+		t.Errorf("account is %q, want bob", bob.Account)
+	}
+
+	want := ":bob!bob@10.0.0.1 ACCOUNT bob"
+	if got := aliceConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("account-notify peer: got %q, want %q", got, want)
+	}
+	if got := carolConn.Lines(); len(got) != 0 {
+		t.Errorf("peer without account-notify got %q", got)
+	}
+
+	testSend(bob, "AUTHENTICATE PLAIN")
+	if got := bobConn.Lines(); !hasLine(got, " 907 bob ") {
+		t.Errorf("second login: got %q, want ERR_SASLALREADY", got)
+	}
+}
+
+func TestRemoveAccount(t *testing.T) {
+	s := newTestServer()
+	accounts := newTestAccounts(s, "bob:hunter2")
+
+	alice, aliceConn := newTestClient(s, "alice", CAP_ACCOUNT_NOTIFY)
+	bob, bobConn := newTestClient(s, "bob")
+	carol, carolConn := newTestClient(s, "carol")
+	newTestChannel(s, "#x", alice, bob, carol)
+	bob.Login("bob")
+	carol.Login("carol")
+	aliceConn.Lines()
+	bobConn.Lines()
+	carolConn.Lines()
+
+	if !s.RemoveAccount("BOB") {
+		t.Fatalf("existing account was not removed")
+	}
+	if accounts.Get("bob") != nil {
+		t.Errorf("account still in the backend")
+	}
+
+	want := ":irc.test 901 bob bob!bob@10.0.0.1 :You are now logged out"
+	if got := bobConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("removed account: got %q, want %q", got, want)
+	}
+	if bob.Account != "" {
+		t.Errorf("still logged in to %q", bob.Account)
+	}
+
+	want = ":bob!bob@10.0.0.1 ACCOUNT *"
+	if got := aliceConn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("account-notify peer: got %q, want %q", got, want)
+	}
+
+	// Other accounts are left alone
+	if got := carolConn.Lines(); len(got) != 0 || carol.Account != "carol" {
+		t.Errorf("other account: got %q, logged in to %q", got, carol.Account)
+	}
+
+	if s.RemoveAccount("bob") {
+		t.Errorf("removed an account that doesn't exist")
+	}
+}
@@ -0,0 +1,239 @@
+package gircd
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/base64"
+import "encoding/binary"
+import "fmt"
+import "strings"
+
+const SASL_SCRAM_SHA_256 = "SCRAM-SHA-256"
+
+// Iterations used for new credentials, the minimum RFC 7677 allows
+const SCRAM_ITERATIONS = 4096
+
+// Size of the salts picked for new credentials
+const SCRAM_SALT_SIZE = 16
+
+// Salted credentials as used by SCRAM (RFC 5802), the password itself can't
+// be recovered from these
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// Account backends that keep SCRAM credentials, needed for SCRAM-SHA-256
+type SCRAMBackend interface {
+	// Returns the name of the account, and its credentials
+	FindSCRAMCredentials(name string) (string, *SCRAMCredentials, bool)
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// The Hi() function from RFC 5802, which is PBKDF2 with HMAC-SHA-256 and a
+// single block of output
+func scramHi(password []byte, salt []byte, iterations int) []byte {
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+
+	u := hmacSHA256(password, append(append([]byte{}, salt...), block...))
+	res := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for idx := range res {
+			res[idx] ^= u[idx]
+		}
+	}
+	return res
+}
+
+// Derives the credentials for a password, a nil salt picks a random one.
+// Passwords are used as given, without SASLprep
+func NewSCRAMCredentials(password string, salt []byte, iterations int) *SCRAMCredentials {
+	if salt == nil {
+		salt = make([]byte, SCRAM_SALT_SIZE)
+		rand.Read(salt)
+	}
+
+	salted := scramHi([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// Returns a random key for Server.SCRAMSecret
+func NewSCRAMSecret() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+// Returns made up credentials for a name that has no account. They are the
+// same every time for the same name and secret (in any case, like account
+// names), so a client can't tell them apart from real ones. No proof matches
+// them
+func fakeSCRAMCredentials(secret []byte, name string) *SCRAMCredentials {
+	name = strings.ToLower(name)
+	return &SCRAMCredentials{
+		Salt:       hmacSHA256(secret, []byte("salt:"+name))[:SCRAM_SALT_SIZE],
+		Iterations: SCRAM_ITERATIONS,
+		StoredKey:  hmacSHA256(secret, []byte("stored:"+name)),
+		ServerKey:  hmacSHA256(secret, []byte("server:"+name)),
+	}
+}
+
+// Returns true if `password` matches the credentials
+func (c *SCRAMCredentials) Check(password string) bool {
+	other := NewSCRAMCredentials(password, c.Salt, c.Iterations)
+	return subtle.ConstantTimeCompare(c.StoredKey, other.StoredKey) == 1
+}
+
+// Splits a SCRAM message into its attributes (e.g. `r=abc,s=def`)
+func parseSCRAM(msg string) (map[string]string, bool) {
+	attrs := make(map[string]string)
+	for _, v := range strings.Split(msg, ",") {
+		if len(v) < 2 || v[1] != '=' {
+			return nil, false
+		}
+		attrs[v[:1]] = v[2:]
+	}
+	return attrs, true
+}
+
+// Undoes the `=2C` and `=3D` escaping of SCRAM usernames
+func unescapeSCRAM(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// SASL SCRAM-SHA-256 (RFC 7677), without channel binding
+type SASLScram struct {
+	// Server part of the nonce, picked on the first step if empty
+	Nonce string
+
+	step      int
+	account   string
+	creds     *SCRAMCredentials
+	gs2Header string
+	nonce     string
+	authMsg   string
+}
+
+func (m *SASLScram) Step(c *Client, data []byte) ([]byte, string, error) {
+	m.step += 1
+	switch m.step {
+	case 1:
+		return m.clientFirst(c, string(data))
+	case 2:
+		return m.clientFinal(string(data))
+	case 3:
+		// The client acknowledges the server signature with an empty response
+		if len(data) != 0 {
+			return nil, "", ERR_SASL_INVALID
+		}
+		return nil, m.account, nil
+	}
+	return nil, "", ERR_SASL_INVALID
+}
+
+// Handles `n,[a=authzid],n=user,r=nonce` and returns the server-first message
+func (m *SASLScram) clientFirst(c *Client, msg string) ([]byte, string, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, "", ERR_SASL_INVALID
+	}
+
+	// We don't do channel binding, `y` means the client could have but
+	//  thinks we can't, which is true
+	if parts[0] != "n" && parts[0] != "y" {
+		return nil, "", ERR_SASL_INVALID
+	}
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+
+	bare := parts[2]
+	attrs, ok := parseSCRAM(bare)
+	if !ok || attrs["n"] == "" || attrs["r"] == "" {
+		return nil, "", ERR_SASL_INVALID
+	}
+
+	backend, ok := c.Server.Accounts.(SCRAMBackend)
+	if !ok {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+	name := unescapeSCRAM(attrs["n"])
+	account, creds, ok := backend.FindSCRAMCredentials(name)
+
+	// We don't let anyone act as somebody else
+	if authz := strings.TrimPrefix(parts[1], "a="); ok && authz != "" && !strings.EqualFold(unescapeSCRAM(authz), account) {
+		ok = false
+	}
+
+	// Failing here would tell anyone which accounts exist, so unknown names
+	//  go through the whole exchange and fail on the proof
+	if !ok {
+		account, creds = "", fakeSCRAMCredentials(c.Server.SCRAMSecret, name)
+	}
+	m.account, m.creds = account, creds
+
+	if m.Nonce == "" {
+		raw := make([]byte, 18)
+		rand.Read(raw)
+		m.Nonce = base64.RawStdEncoding.EncodeToString(raw)
+	}
+	m.nonce = attrs["r"] + m.Nonce
+
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", m.nonce,
+		base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	m.authMsg = bare + "," + serverFirst
+	return []byte(serverFirst), "", nil
+}
+
+// Handles `c=binding,r=nonce,p=proof` and returns the server-final message
+func (m *SASLScram) clientFinal(msg string) ([]byte, string, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx == -1 {
+		return nil, "", ERR_SASL_INVALID
+	}
+	withoutProof := msg[:idx]
+
+	attrs, ok := parseSCRAM(msg)
+	if !ok {
+		return nil, "", ERR_SASL_INVALID
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) || attrs["r"] != m.nonce {
+		return nil, "", ERR_SASL_INVALID
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, "", ERR_SASL_INVALID
+	}
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage), and it has to
+	//  hash to the StoredKey
+	m.authMsg += "," + withoutProof
+	sig := hmacSHA256(m.creds.StoredKey, []byte(m.authMsg))
+	for i := range proof {
+		proof[i] ^= sig[i]
+	}
+	key := sha256.Sum256(proof)
+	if subtle.ConstantTimeCompare(key[:], m.creds.StoredKey) != 1 || m.account == "" {
+		return nil, "", ERR_SASL_CREDENTIALS
+	}
+
+	serverSig := hmacSHA256(m.creds.ServerKey, []byte(m.authMsg))
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)), "", nil
+}
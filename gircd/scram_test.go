@@ -0,0 +1,118 @@
+package gircd
+
+import "encoding/base64"
+import "strings"
+import "testing"
+
+// The SCRAM-SHA-256 exchange from RFC 7677, section 3
+const (
+	SCRAM_TEST_SALT         = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	SCRAM_TEST_SERVER_NONCE = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	SCRAM_TEST_CLIENT_FIRST = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	SCRAM_TEST_SERVER_FIRST = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	SCRAM_TEST_CLIENT_FINAL = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	SCRAM_TEST_SERVER_FINAL = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+// Returns a client on a server that has the RFC 7677 `user` account, with
+// password `pencil`
+func newSCRAMTestClient(t *testing.T) *Client {
+	salt, err := base64.StdEncoding.DecodeString(SCRAM_TEST_SALT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	accounts := newTestAccounts(s, "user:pencil")
+	accounts.Get("user").Creds = NewSCRAMCredentials("pencil", salt, SCRAM_ITERATIONS)
+
+	cl, _ := newTestClient(s, "alice")
+	return cl
+}
+
+func TestSCRAMVector(t *testing.T) {
+	cl := newSCRAMTestClient(t)
+	m := &SASLScram{Nonce: SCRAM_TEST_SERVER_NONCE}
+
+	steps := []struct {
+		In   string
+		Want string
+	}{
+		{SCRAM_TEST_CLIENT_FIRST, SCRAM_TEST_SERVER_FIRST},
+		{SCRAM_TEST_CLIENT_FINAL, SCRAM_TEST_SERVER_FINAL},
+	}
+	for _, v := range steps {
+		out, account, err := m.Step(cl, []byte(v.In))
+		if err != nil || account != "" {
+			t.Fatalf("%q: got account %q, error %v", v.In, account, err)
+		}
+		if string(out) != v.Want {
+			t.Fatalf("%q: got %q, want %q", v.In, out, v.Want)
+		}
+	}
+
+	_, account, err := m.Step(cl, nil)
+	if err != nil || account != "user" {
+		t.Errorf("final step: got account %q, error %v, want user", account, err)
+	}
+}
+
+func TestSCRAMWrongProof(t *testing.T) {
+	cl := newSCRAMTestClient(t)
+	m := &SASLScram{Nonce: SCRAM_TEST_SERVER_NONCE}
+
+	if _, _, err := m.Step(cl, []byte(SCRAM_TEST_CLIENT_FIRST)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same proof with its last byte changed
+	final := SCRAM_TEST_CLIENT_FINAL[:len(SCRAM_TEST_CLIENT_FINAL)-4] + "AAA="
+	if _, _, err := m.Step(cl, []byte(final)); err != ERR_SASL_CREDENTIALS {
+		t.Errorf("got error %v, want ERR_SASL_CREDENTIALS", err)
+	}
+}
+
+func TestSCRAMCredentialsCheck(t *testing.T) {
+	creds := NewSCRAMCredentials("pencil", nil, SCRAM_ITERATIONS)
+	if !creds.Check("pencil") {
+		t.Errorf("right password was refused")
+	}
+	if creds.Check("pen") {
+		t.Errorf("wrong password was accepted")
+	}
+}
+
+func TestSCRAMUnknownUser(t *testing.T) {
+	cl := newSCRAMTestClient(t)
+
+	// Returns the server-first message for `name`, with the nonce dropped
+	serverFirst := func(name string) string {
+		m := &SASLScram{Nonce: SCRAM_TEST_SERVER_NONCE}
+		out, _, err := m.Step(cl, []byte("n,,n="+name+",r=rOprNGfwEbeRWgbNEkqO"))
+		if err != nil {
+			t.Fatalf("%s: got error %v, want a server-first message", name, err)
+		}
+		return strings.SplitN(string(out), ",", 2)[1]
+	}
+
+	// A made up salt looks like a real one, and doesn't change between tries
+	known, unknown := serverFirst("user"), serverFirst("nobody")
+	if len(known) != len(unknown) || !strings.HasSuffix(unknown, ",i=4096") {
+		t.Errorf("unknown user: got %q, want the shape of %q", unknown, known)
+	}
+	if again := serverFirst("NOBODY"); again != unknown {
+		t.Errorf("unknown user: got %q, then %q", unknown, again)
+	}
+	if other := serverFirst("someone"); other == unknown {
+		t.Errorf("two unknown users got the same salt")
+	}
+
+	// The exchange only fails on the proof
+	m := &SASLScram{Nonce: SCRAM_TEST_SERVER_NONCE}
+	if _, _, err := m.Step(cl, []byte("n,,n=nobody,r=rOprNGfwEbeRWgbNEkqO")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Step(cl, []byte(SCRAM_TEST_CLIENT_FINAL)); err != ERR_SASL_CREDENTIALS {
+		t.Errorf("got error %v, want ERR_SASL_CREDENTIALS", err)
+	}
+}
@@ -1,98 +1,352 @@
 package gircd
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	LINE_TERM     = "\r\n"
-	PING_TIMEOUT  = time.Second * 120
-	RECV_BUF_SIZE = 2048
-	BREATH_TIME   = time.Millisecond * 5
-	MAX_CHANNELS  = 64
-	MAX_LINE_SIZE = 510
+	LINE_TERM             = "\r\n"
+	PING_TIMEOUT          = time.Second * 120
+	RECV_BUF_SIZE         = 2048
+	BREATH_TIME           = time.Millisecond * 5
+	TLS_HANDSHAKE_TIMEOUT = time.Second * 10
+	MAX_CHANNELS          = 64
+	MAX_CHAN_LEN          = 50
+	MAX_NICK_LEN          = 30
+	MAX_TOPIC_LEN         = 390
+	MAX_KICK_LEN          = 255
+	MAX_AWAY_LEN          = 200
+	MAX_NAME_LEN          = 128
+	MAX_TARGETS           = 4
+	MAX_LINE_SIZE         = 510
+	MAX_SENDQ             = 1024 * 1024
 
 	// N packets per 5 seconds must be less than this
 	MESSAGES_PER_5_SEC = 10
 )
 
+// Build details, meant to be set with `-ldflags "-X ..."` at build time
+var (
+	BUILD_VERSION = "dev"
+	BUILD_COMMIT  = "unknown"
+)
+
 type ServerInfo struct {
 	Name    string
+	Network string
 	Version int
 	MOTD    []string
+	Created time.Time
+
+	// Build the server is running, and when it was started
+	BuildVersion string
+	Commit       string
+	StartTime    time.Time
+
+	// Contact details sent in reply to ADMIN
+	AdminLoc1  string
+	AdminLoc2  string
+	AdminEmail string
 }
 
 type Server struct {
 	Conn     net.Listener
-	Clients  map[int]*Client
 	Channels map[string]*Channel
 
+	// Clients by ID, TLS connections are accepted from their own goroutines
+	//  so this is only touched under ClientLock (see ClientList)
+	Clients    map[int]*Client
+	ClientLock *sync.RWMutex
+
+	// Clients indexed by their folded nick
+	Nicks map[string]*Client
+	Lock  *sync.RWMutex
+
 	// Config
 	Host     string
 	Port     string
 	Password string
 
+	// Optional TLS listener, clients may send a certificate for SASL EXTERNAL
+	TLSPort   string
+	TLSConfig *tls.Config
+
+	// Where accounts are checked for SASL, nil disables SASL
+	Accounts AccountBackend
+
+	// Key the SCRAM salts of unknown accounts are derived from, random unless
+	//  set. Keep it the same across restarts so the salts don't change
+	SCRAMSecret []byte
+
+	// How nicks and channel names are compared (one of CASEMAPPING_*), set
+	//  with SetCaseMapping before the server is started
+	CaseMapping string
+
+	// Allowed channel prefixes (CHANTYPES), and max channel name length
+	//  including the prefix (CHANNELLEN)
+	ChanTypes  string
+	ChannelLen int
+
+	// Length limits for nicks, topics, kick reasons, away messages and
+	//  realnames, and how many targets a command may have
+	NickLen    int
+	TopicLen   int
+	KickLen    int
+	AwayLen    int
+	NameLen    int
+	MaxTargets int
+
+	// ISUPPORT tokens advertised on registration, see BuildISupport
+	ISupport *ISupport
+
+	// IRCv3 capabilities offered in CAP LS, see BuildCaps
+	Caps         *CapSet
+	DisabledCaps []string
+
+	// Recently used nicknames (WHOWAS and nick-delay)
+	WhoWas *WhoWas
+
+	// Where messages are kept for CHATHISTORY, nil disables history. It is
+	//  kept for HistoryRetention, unless its channel has a retention of its
+	//  own (see SetChannelRetention)
+	History          HistoryStore
+	HistoryRetention HistoryRetention
+	ChannelRetention map[string]HistoryRetention
+
 	// Is the server running?
 	running bool
 	id_inc  int
 
+	// Used to build unique msgids, see NewMsgID
+	msgid_base string
+	msgid_inc  uint64
+
+	// Highest number of registered users seen at once
+	MaxUsers int
+
+	// K-lines, operator blocks and connection classes (see STATS k, o and y)
+	Bans    []*Ban
+	Opers   []*OperBlock
+	Classes []*ConnClass
+
+	// Per-command usage, for STATS m
+	CommandStats *CommandStats
+
 	ServerInfo
 }
 
 func NewServer(host string, port string, password string) *Server {
-	return &Server{
-		Clients:  make(map[int]*Client, 0),
-		Channels: make(map[string]*Channel, 0),
-		running:  false,
-		id_inc:   0,
-		Host:     host,
-		Port:     port,
-		Password: password,
+	s := &Server{
+		Clients:     make(map[int]*Client, 0),
+		Channels:    make(map[string]*Channel, 0),
+		Nicks:       make(map[string]*Client),
+		Lock:        new(sync.RWMutex),
+		ClientLock:  new(sync.RWMutex),
+		running:     false,
+		id_inc:      0,
+		msgid_base:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		Host:        host,
+		Port:        port,
+		Password:    password,
+		CaseMapping: CASEMAPPING_RFC1459,
+		ChanTypes:   CHAN_PREFIX_DEFAULT + CHAN_PREFIX_SERVER,
+		ChannelLen:  MAX_CHAN_LEN,
+		NickLen:     MAX_NICK_LEN,
+		TopicLen:    MAX_TOPIC_LEN,
+		KickLen:     MAX_KICK_LEN,
+		AwayLen:     MAX_AWAY_LEN,
+		NameLen:     MAX_NAME_LEN,
+		MaxTargets:  MAX_TARGETS,
+		WhoWas:      NewWhoWas(WHOWAS_SIZE),
+		SCRAMSecret: NewSCRAMSecret(),
+		History:     NewMemoryHistory(),
+		HistoryRetention: HistoryRetention{
+			MaxEntries: HISTORY_SIZE,
+		},
+		ChannelRetention: make(map[string]HistoryRetention),
+		Bans:             make([]*Ban, 0),
+		Opers:            make([]*OperBlock, 0),
+		Classes: []*ConnClass{
+			{
+				Name:     "default",
+				PingFreq: PING_TIMEOUT,
+				MaxSendQ: MAX_SENDQ,
+			},
+		},
+		CommandStats: NewCommandStats(),
 		ServerInfo: ServerInfo{
-			Name:    "GIRCD",
-			Version: 1,
+			Name:         "GIRCD",
+			Network:      "GIRCD",
+			Version:      1,
+			Created:      time.Now(),
+			BuildVersion: BUILD_VERSION,
+			Commit:       BUILD_COMMIT,
+			StartTime:    time.Now(),
 			MOTD: []string{
 				"Welcome to GIRCD Test server!",
 				"Please enjoy your stay and be nice!",
 			},
 		},
 	}
+	s.BuildISupport()
+	s.BuildCaps()
+	return s
 }
 
-func (s *Server) FindUserByNick(nick string) *Client {
-	for _, v := range s.Clients {
-		if v.Nick == nick {
-			return v
+// Rebuilds the ISUPPORT tokens from the config and mode tables (this happens
+// on Start, call it again after changing the config later on)
+func (s *Server) BuildISupport() {
+	s.ISupport = NewISupport().
+		Set(R_NETWORK, s.Network).
+		Set("CASEMAPPING", s.CaseMapping).
+		Set("CHANTYPES", s.ChanTypes).
+		Set("CHANLIMIT", fmt.Sprintf("%s:%d", s.ChanTypes, MAX_CHANNELS)).
+		Set("PREFIX", fmt.Sprintf("(%s)%s", CHAN_USER_MODES, CHAN_USER_PREFIXES)).
+		Set("CHANMODES", strings.Join([]string{
+			CHAN_MODES_LIST, CHAN_MODES_PARAM, CHAN_MODES_SET_PARAM, CHAN_MODES_FLAG,
+		}, ",")).
+		Set("NICKLEN", strconv.Itoa(s.NickLen)).
+		Set("CHANNELLEN", strconv.Itoa(s.ChannelLen)).
+		Set("TOPICLEN", strconv.Itoa(s.TopicLen)).
+		Set("KICKLEN", strconv.Itoa(s.KickLen)).
+		Set("AWAYLEN", strconv.Itoa(s.AwayLen)).
+		Set("NAMELEN", strconv.Itoa(s.NameLen)).
+		Set("MAXTARGETS", strconv.Itoa(s.MaxTargets)).
+		Set("WHOX", "")
+
+	if s.History != nil {
+		s.ISupport.Set("CHATHISTORY", strconv.Itoa(HISTORY_MAX_LIMIT)).
+			Set("MSGREFTYPES", "timestamp,msgid")
+	}
+}
+
+// Rebuilds everything derived from the config, and lets cap-notify clients
+// know about capabilities that were added or removed
+func (s *Server) Rehash() {
+	old := s.Caps
+	s.BuildISupport()
+	s.BuildCaps()
+
+	removed := make([]Capability, 0)
+	for _, v := range old.List() {
+		if !s.Caps.Has(v.Name) {
+			removed = append(removed, v)
 		}
 	}
-	return nil
+	s.NotifyCaps(s.Caps.Diff(old), removed)
+}
+
+// Changes the casemapping used to compare nicks and channel names, and
+// re-indexes everything under the new mapping. Returns false (and changes
+// nothing) for a mapping we don't implement
+func (s *Server) SetCaseMapping(mapping string) bool {
+	switch mapping {
+	case CASEMAPPING_RFC1459, CASEMAPPING_STRICT_RFC1459, CASEMAPPING_ASCII:
+	default:
+		return false
+	}
+
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.CaseMapping = mapping
+	s.ISupport.Set("CASEMAPPING", mapping)
+
+	nicks := make(map[string]*Client, len(s.Nicks))
+	for _, v := range s.Nicks {
+		nicks[s.Fold(v.Nick)] = v
+	}
+	s.Nicks = nicks
+
+	channels := make(map[string]*Channel, len(s.Channels))
+	for _, v := range s.Channels {
+		channels[s.Fold(v.GetName())] = v
+	}
+	s.Channels = channels
+
+	retention := make(map[string]HistoryRetention, len(s.ChannelRetention))
+	for k, v := range s.ChannelRetention {
+		retention[s.Fold(k)] = v
+	}
+	s.ChannelRetention = retention
+	return true
+}
+
+// Folds a nick or channel name following the servers casemapping
+func (s *Server) Fold(name string) string {
+	return Casefold(s.CaseMapping, name)
+}
+
+// Returns true if `name` matches wildcard mask `mask` under the casemapping
+func (s *Server) Match(mask string, name string) bool {
+	return MatchMask(s.Fold(mask), s.Fold(name))
+}
+
+// Returns the client using `nick` (compared under the casemapping), or nil
+func (s *Server) FindUserByNick(nick string) *Client {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+	return s.Nicks[s.Fold(nick)]
+}
+
+// Changes the nick of client `cl`, keeping the nick index in sync
+func (s *Server) SetNick(cl *Client, nick string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if cl.Nick != "" && s.Nicks[s.Fold(cl.Nick)] == cl {
+		delete(s.Nicks, s.Fold(cl.Nick))
+	}
+	cl.Nick = nick
+	s.Nicks[s.Fold(nick)] = cl
 }
 
 func (s *Server) NewChannel(prefix string, name string) *Channel {
 	channel := NewChannel(prefix, name, s)
 	go channel.SendLoop()
-	s.Channels[channel.GetName()] = channel
+	s.Channels[s.Fold(channel.GetName())] = channel
 	return channel
 }
 
+// Returns true if `char` is an allowed channel prefix
+func (s *Server) IsChannelPrefix(char byte) bool {
+	return strings.IndexByte(s.ChanTypes, char) != -1
+}
+
+// Returns true if `name` (including its prefix) is a valid channel name
+func (s *Server) ValidChannelName(name string) bool {
+	if len(name) < 2 || len(name) > s.ChannelLen || !s.IsChannelPrefix(name[0]) {
+		return false
+	}
+	return !strings.ContainsAny(name, " ,\x07\x00\r\n")
+}
+
+// Channels are stored under their folded name, but keep the case they were
+// created with for display
 func (s *Server) GetChannel(name string) *Channel {
-	return s.Channels[name]
+	return s.Channels[s.Fold(name)]
 }
 
 func (s *Server) RmvChannel(c *Channel) {
 	// Force loop to stop
 	c.Alive = false
-	c.Send("")
-	delete(s.Channels, c.GetName())
+	c.Send(nil)
+	delete(s.Channels, s.Fold(c.GetName()))
+
+	// The history is kept (until it ages out) for whoever joins next, as
+	//  people reconnecting want to catch up on it
 }
 
 func (s *Server) HasChannel(name string) bool {
-	if _, c := s.Channels[name]; c {
+	if _, c := s.Channels[s.Fold(name)]; c {
 		return true
 	}
 	return false
@@ -102,72 +356,150 @@ func (s *Server) GetHash() string {
 	return s.Host
 }
 
-// Returns the next availible ID, skips over used ID's
+// Returns the version string sent to clients (e.g. gircd-1.dev)
+func (s *Server) GetVersion() string {
+	return fmt.Sprintf("gircd-%d.%s", s.Version, s.BuildVersion)
+}
+
+// Returns true if server mask `mask` (as sent with e.g. VERSION) matches us
+func (s *Server) IsLocal(mask string) bool {
+	return s.Match(mask, s.GetHash())
+}
+
+// Counts the clients that are registered, and updates MaxUsers
+func (s *Server) CountUsers() int {
+	var count int = 0
+	for _, v := range s.ClientList() {
+		if v.State == STATE_ACTIVE {
+			count += 1
+		}
+	}
+	if count > s.MaxUsers {
+		s.MaxUsers = count
+	}
+	return count
+}
+
+// Returns the next availible ID, skips over used ID's. Every call returns a
+// different ID, even from different goroutines
 func (s *Server) NextID() int {
-	for s.HasClient(s.id_inc) {
+	s.ClientLock.Lock()
+	defer s.ClientLock.Unlock()
+	for {
+		if _, used := s.Clients[s.id_inc]; !used {
+			break
+		}
 		s.id_inc += 1
 	}
-	return s.id_inc
+	id := s.id_inc
+	s.id_inc += 1
+	return id
 }
 
 // Checks if a client of ID i exists
 func (s *Server) HasClient(i int) bool {
-	if _, c := s.Clients[i]; c {
-		return true
-	}
-	return false
+	s.ClientLock.RLock()
+	defer s.ClientLock.RUnlock()
+	_, c := s.Clients[i]
+	return c
 }
 
 // Returns a client (or nil) of ID i
 func (s *Server) GetClient(i int) *Client {
-	v, _ := s.Clients[i]
-	return v
+	s.ClientLock.RLock()
+	defer s.ClientLock.RUnlock()
+	return s.Clients[i]
+}
+
+// Returns a snapshot of the clients, to loop over without holding ClientLock
+func (s *Server) ClientList() []*Client {
+	s.ClientLock.RLock()
+	defer s.ClientLock.RUnlock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, v := range s.Clients {
+		clients = append(clients, v)
+	}
+	return clients
 }
 
 // Removes a client
 func (s *Server) RmvClient(i int) bool {
-	if s.HasClient(i) {
-		delete(s.Clients, i)
-		return true
+	s.ClientLock.Lock()
+	cl, has := s.Clients[i]
+	delete(s.Clients, i)
+	s.ClientLock.Unlock()
+	if !has {
+		return false
 	}
-	return false
+
+	s.Lock.Lock()
+	if cl.Nick != "" && s.Nicks[s.Fold(cl.Nick)] == cl {
+		delete(s.Nicks, s.Fold(cl.Nick))
+	}
+	s.Lock.Unlock()
+	return true
 }
 
 // Adds a client
 func (s *Server) AddClient(c *Client) {
-	if s.HasClient(c.ID) {
-		if s.GetClient(c.ID) == c {
+	s.ClientLock.Lock()
+	defer s.ClientLock.Unlock()
+	if v, has := s.Clients[c.ID]; has {
+		if v == c {
 			log.Printf("Warning: AddClient is ignoring request, client was already added!")
 			return
 		}
-		log.Printf("[WARN] AddClient failed, client w/ ID %s already exists and is not identical!", c.ID)
+		log.Printf("[WARN] AddClient failed, client w/ ID %d already exists and is not identical!", c.ID)
 		return
 	}
 	s.Clients[c.ID] = c
 }
 
-// Loops over s.Conn.Accept()
-func (s *Server) AcceptLoop() {
+// Loops over ln.Accept()
+func (s *Server) AcceptLoop(ln net.Listener) {
 	for s.running {
-		conn, err := s.Conn.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			log.Printf("Could not accept new connection: %s\n", err)
 			continue
 		}
 
-		id := s.NextID()
-		log.Printf("Accepting new connection: %d\n", id)
-		cli := NewClient(id, s, conn)
-		s.AddClient(cli)
+		// Clients are polled with short read deadlines, which would break the
+		//  TLS handshake, so get that out of the way first
+		if tc, ok := conn.(*tls.Conn); ok {
+			go s.AcceptTLS(tc)
+			continue
+		}
+		s.AcceptConn(conn)
+	}
+}
 
-		NewUpdate(UPDATE_LOGIN_TIMEOUT, cli).Set("start", time.Now()).Queue()
+// Finishes the TLS handshake of a new connection before accepting it
+func (s *Server) AcceptTLS(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("TLS handshake failed: %s\n", err)
+		conn.Close()
+		return
 	}
+	conn.SetDeadline(time.Time{})
+	s.AcceptConn(conn)
+}
+
+// Adds a client for a new connection
+func (s *Server) AcceptConn(conn net.Conn) {
+	id := s.NextID()
+	log.Printf("Accepting new connection: %d\n", id)
+	cli := NewClient(id, s, conn)
+	s.AddClient(cli)
+
+	NewUpdate(UPDATE_LOGIN_TIMEOUT, cli).Set("start", time.Now()).Queue()
 }
 
 // Loops over clients and pulls from the update queue
 func (s *Server) UpdateLoop() {
 	for s.running {
-		for _, v := range s.Clients {
+		for _, v := range s.ClientList() {
 			if v.NeedUpdate() {
 				v.Update()
 			}
@@ -180,19 +512,13 @@ func (s *Server) UpdateLoop() {
 // Loops over clients and checks to see if they have timed out
 func (s *Server) PingLoop() {
 	for s.running {
-		for _, v := range s.Clients {
+		for _, v := range s.ClientList() {
 			if !v.CheckPing() {
 				v.Log("Client timed out on ping!")
 				v.ForceDC("Ping Timeout")
 			}
 
-			if v.Messages > MESSAGES_PER_5_SEC {
-				v.LogF("Client %s seems to be spamming... kicking!")
-				v.ForceDC("Rate Limiting")
-			}
-			v.Lock.Lock()
-			v.Messages = 0
-			v.Lock.Unlock()
+			v.CheckRateLimit()
 		}
 		time.Sleep(time.Second * 5)
 	}
@@ -201,8 +527,10 @@ func (s *Server) PingLoop() {
 // Reads
 func (s *Server) ReadLoop() {
 	for s.running {
-		for _, v := range s.Clients {
+		for _, v := range s.ClientList() {
+			// Poll each connection, timeouts just mean there was nothing to read
 			buff := make([]byte, RECV_BUF_SIZE)
+			v.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 1))
 			c, e := v.Conn.Read(buff)
 			if e != nil {
 				if nerr, ok := e.(net.Error); ok && nerr.Timeout() {
@@ -216,26 +544,10 @@ func (s *Server) ReadLoop() {
 				v.LogF("Error reading: %s\n", e)
 				continue
 			}
-			v.LogF("Read bytes: %s\n", c)
-			if c > MAX_LINE_SIZE {
-				v.Log("WARNING: Line size above MAX_LINE_SIZE, skipping...")
-				v.ForceDC("Line size over maximum")
-				continue
-			}
+			v.LogF("Read bytes: %d\n", c)
+			atomic.AddInt64(&v.Stats.RecvBytes, int64(c))
 			if c > 0 {
-				data := string(buff[:c])
-				for _, line := range strings.Split(data, LINE_TERM) {
-					if len(line) == 0 {
-						continue
-					}
-					msg := NewMsgFrom(line)
-					if msg == nil {
-						continue
-					}
-					v.Messages += 1
-					v.MsgQ <- msg
-					v.LogF("Added msg to buffer!\n")
-				}
+				v.Feed(buff[:c])
 			}
 		}
 		time.Sleep(BREATH_TIME)
@@ -244,7 +556,7 @@ func (s *Server) ReadLoop() {
 
 func (s *Server) ParseLoop() {
 	for s.running {
-		for _, v := range s.Clients {
+		for _, v := range s.ClientList() {
 			if len(v.MsgQ) > 0 {
 				v.LogF("Parsing Queue...\n")
 				val := <-v.MsgQ
@@ -262,16 +574,27 @@ func (s *Server) Start() {
 	}
 	s.running = true
 	s.Conn = ln
+	s.StartTime = time.Now()
 
 	log.Printf("Loading Parser")
 	InitParser()
+	s.BuildISupport()
+	s.BuildCaps()
+
+	if s.TLSConfig != nil && s.TLSPort != "" {
+		tln, err := tls.Listen("tcp", ":"+s.TLSPort, s.TLSConfig)
+		if err != nil {
+			log.Panicf("Could not listen for TLS: %s\n", err)
+		}
+		go s.AcceptLoop(tln)
+	}
 
 	log.SetOutput(os.Stdout)
 	log.Printf("Running!")
 	// go s.PingLoop()
 	go s.ReadLoop()
 	go s.ParseLoop()
-	s.AcceptLoop()
+	s.AcceptLoop(ln)
 }
 
 func (s *Server) HasPassword() bool {
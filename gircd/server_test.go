@@ -0,0 +1,169 @@
+package gircd
+
+import "fmt"
+import "sync"
+import "testing"
+
+// Sizes of the server the lookup benchmarks run against
+const (
+	BENCH_USERS    = 10000
+	BENCH_CHANNELS = 1000
+	BENCH_JOINS    = 10
+)
+
+// A server with BENCH_USERS clients, each on BENCH_JOINS of the
+// BENCH_CHANNELS channels. Everyone is on the first one, like a network's
+// help channel
+type benchServer struct {
+	Server   *Server
+	Clients  []*Client
+	Channels []*Channel
+
+	// Channel members as a slice, the way channels used to keep them
+	Members map[*Channel][]*Client
+}
+
+var bench *benchServer
+
+func newBenchServer() *benchServer {
+	if bench != nil {
+		return bench
+	}
+
+	s := newTestServer()
+	bench = &benchServer{Server: s, Members: make(map[*Channel][]*Client)}
+	for idx := 0; idx < BENCH_CHANNELS; idx++ {
+		bench.Channels = append(bench.Channels, newTestChannel(s, fmt.Sprintf("#chan%d", idx)))
+	}
+	for idx := 0; idx < BENCH_USERS; idx++ {
+		cl, _ := newTestClient(s, fmt.Sprintf("user%d", idx))
+		bench.Clients = append(bench.Clients, cl)
+		for j := 0; j < BENCH_JOINS; j++ {
+			ch := bench.Channels[0]
+			if j > 0 {
+				ch = bench.Channels[1+(idx+j*97)%(BENCH_CHANNELS-1)]
+			}
+			ch.AddMember(cl)
+			bench.Members[ch] = append(bench.Members[ch], cl)
+		}
+	}
+	return bench
+}
+
+// FindUserByNick as it was before nicks were indexed
+func linearFindUserByNick(s *Server, nick string) *Client {
+	nick = s.Fold(nick)
+	for _, v := range s.Clients {
+		if v.Nick != "" && s.Fold(v.Nick) == nick {
+			return v
+		}
+	}
+	return nil
+}
+
+// IsMember as it was before members were kept in a map
+func linearIsMember(members []*Client, cl *Client) bool {
+	for _, v := range members {
+		if v == cl {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkFindUserByNick(b *testing.B) {
+	bs := newBenchServer()
+	b.Run("linear", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			nick := bs.Clients[n%BENCH_USERS].Nick
+			if linearFindUserByNick(bs.Server, nick) == nil {
+				b.Fatalf("%s not found", nick)
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			nick := bs.Clients[n%BENCH_USERS].Nick
+			if bs.Server.FindUserByNick(nick) == nil {
+				b.Fatalf("%s not found", nick)
+			}
+		}
+	})
+}
+
+func BenchmarkIsMember(b *testing.B) {
+	bs := newBenchServer()
+	for _, size := range []string{"small", "large"} {
+		// Small channels are picked round-robin, the large one has everyone
+		pick := func(n int) *Channel {
+			if size == "large" {
+				return bs.Channels[0]
+			}
+			return bs.Channels[1+n%(BENCH_CHANNELS-1)]
+		}
+
+		b.Run(size+"/linear", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				ch := pick(n)
+				linearIsMember(bs.Members[ch], bs.Clients[n%BENCH_USERS])
+			}
+		})
+		b.Run(size+"/map", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				pick(n).IsMember(bs.Clients[n%BENCH_USERS])
+			}
+		})
+	}
+}
+
+func TestFindUserByNick(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "Alice")
+
+	if cl := s.FindUserByNick("ALICE"); cl != alice {
+		t.Errorf("FindUserByNick(ALICE) = %v, want alice", cl)
+	}
+
+	s.SetNick(alice, "carol")
+	if cl := s.FindUserByNick("alice"); cl != nil {
+		t.Errorf("old nick still found after a nick change")
+	}
+	if cl := s.FindUserByNick("Carol"); cl != alice {
+		t.Errorf("FindUserByNick(Carol) = %v, want alice", cl)
+	}
+}
+
+func TestAcceptConnConcurrent(t *testing.T) {
+	s := newTestServer()
+
+	// TLS connections are accepted from a goroutine each, while the other
+	//  loops go over the clients
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				for _, v := range s.ClientList() {
+					s.HasClient(v.ID)
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 50; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.AcceptConn(&testConn{Addr: "10.0.0.1"})
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if got := len(s.ClientList()); got != 50 {
+		t.Errorf("got %d clients, want 50", got)
+	}
+}
@@ -0,0 +1,197 @@
+package gircd
+
+import "crypto/subtle"
+import "fmt"
+import "sort"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// STATS queries anyone may run, the rest are operator only
+const STATS_PUBLIC = "u"
+
+// A K-line, keeps matching user@host masks from registering
+type Ban struct {
+	Mask   string
+	Reason string
+	Setter string
+	Time   time.Time
+}
+
+// An operator block, clients matching Mask may OPER up as Name
+type OperBlock struct {
+	Name     string
+	Password string
+	Mask     string
+	Class    string
+}
+
+// A connection class, sets the limits for the clients put in it
+type ConnClass struct {
+	Name        string
+	PingFreq    time.Duration
+	ConnectFreq time.Duration
+	MaxLinks    int
+	MaxSendQ    int
+}
+
+// Usage of a single command, for STATS m
+type CommandStat struct {
+	Tag   string
+	Count int
+	Bytes int
+}
+
+// Per-command usage counters, collected in Msg.Parse
+type CommandStats struct {
+	Commands map[string]*CommandStat
+	Lock     *sync.Mutex
+}
+
+// Per-connection traffic counters, the fields are only touched with
+// sync/atomic so Write can be called from any goroutine
+type ConnStats struct {
+	SentMsgs  int64
+	SentBytes int64
+	RecvMsgs  int64
+	RecvBytes int64
+
+	// Bytes being written to the connection, and bytes read off it that
+	//  have not been parsed yet
+	SendQ int64
+	RecvQ int64
+}
+
+func NewCommandStats() *CommandStats {
+	return &CommandStats{
+		Commands: make(map[string]*CommandStat),
+		Lock:     new(sync.Mutex),
+	}
+}
+
+// Counts one use of the command tag, with a line of size bytes
+func (s *CommandStats) Add(tag string, size int) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	st, has := s.Commands[tag]
+	if !has {
+		st = &CommandStat{Tag: tag}
+		s.Commands[tag] = st
+	}
+	st.Count += 1
+	st.Bytes += size
+}
+
+// Returns a copy of the counters, sorted by command
+func (s *CommandStats) List() []CommandStat {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	res := make([]CommandStat, 0, len(s.Commands))
+	for _, v := range s.Commands {
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Tag < res[b].Tag
+	})
+	return res
+}
+
+// Returns the first ban matching the client, or nil
+func (s *Server) FindBan(cl *Client) *Ban {
+	mask := fmt.Sprintf("%s@%s", cl.User, cl.GetAddr())
+	for _, v := range s.Bans {
+		if s.Match(v.Mask, mask) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Makes the client an operator, if it matches the operator block `name` and
+// knows its password
+func (c *Client) Oper(name string, password string) {
+	var block *OperBlock
+	for _, v := range c.Server.Opers {
+		if v.Name == name {
+			block = v
+			break
+		}
+	}
+
+	mask := fmt.Sprintf("%s@%s", c.User, c.GetAddr())
+	if block == nil || !c.Server.Match(block.Mask, mask) {
+		c.Resp(ERR_NOOPERHOST).Set(":No O-lines for your host").Send()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(block.Password), []byte(password)) != 1 {
+		c.Resp(ERR_PASSWDMISMATCH).Set(":Password incorrect").Send()
+		return
+	}
+
+	c.GlobalOp = true
+	c.LogF("Client is now an operator as %s", block.Name)
+	c.Resp(RPL_YOUREOPER).Set(":You are now an IRC operator").Send()
+}
+
+// Formats a duration as "D days, HH:MM:SS"
+func FormatUptime(d time.Duration) string {
+	secs := int(d.Seconds())
+	return fmt.Sprintf("%d days, %02d:%02d:%02d", secs/86400, (secs/3600)%24, (secs/60)%60, secs%60)
+}
+
+// Sends the reply to STATS query q, operator only queries are refused with
+// ERR_NOPRIVILEGES
+func (c *Client) SendStats(q string) {
+	s := c.Server
+
+	if !c.GlobalOp && !strings.Contains(STATS_PUBLIC, q) {
+		c.Resp(ERR_NOPRIVILEGES).Set(":Permission Denied- You're not an IRC operator").Send()
+		return
+	}
+
+	switch q {
+	case "u":
+		c.Resp(RPL_STATSUPTIME).SetF(":Server Up %s", FormatUptime(time.Since(s.StartTime))).Send()
+	case "m":
+		for _, v := range s.CommandStats.List() {
+			c.Resp(RPL_STATSCOMMANDS).Set(v.Tag).Set(v.Count).Set(v.Bytes).Set(0).Send()
+		}
+	case "l":
+		for _, v := range s.ClientList() {
+			st := v.Stats
+			name := fmt.Sprintf("%s[%s@%s]", v.Nick, v.User, v.GetAddr())
+			// Trailing is the time the connection has been open, and the RecvQ
+			c.Resp(RPL_STATSLINKINFO).Set(name).
+				Set(atomic.LoadInt64(&st.SendQ)).
+				Set(atomic.LoadInt64(&st.SentMsgs)).
+				Set(atomic.LoadInt64(&st.SentBytes)/1024).
+				Set(atomic.LoadInt64(&st.RecvMsgs)).
+				Set(atomic.LoadInt64(&st.RecvBytes)/1024).
+				SetF(":%d %d", int(time.Since(v.Connected).Seconds()), atomic.LoadInt64(&st.RecvQ)).Send()
+		}
+	case "k":
+		for _, v := range s.Bans {
+			user, host := "*", v.Mask
+			if idx := strings.Index(v.Mask, "@"); idx != -1 {
+				user, host = v.Mask[:idx], v.Mask[idx+1:]
+			}
+			c.Resp(RPL_STATSKLINE).Set("K").Set(host).Set("*").Set(user).SetF(":%s", v.Reason).Send()
+		}
+	case "o":
+		for _, v := range s.Opers {
+			c.Resp(RPL_STATSOLINE).Set("O").Set(v.Mask).Set("*").Set(v.Name).Set(v.Class).Send()
+		}
+	case "y":
+		for _, v := range s.Classes {
+			c.Resp(RPL_STATSYLINE).Set("Y").Set(v.Name).
+				Set(int(v.PingFreq.Seconds())).
+				Set(int(v.ConnectFreq.Seconds())).
+				Set(v.MaxLinks).
+				Set(v.MaxSendQ).Send()
+		}
+	}
+	c.Resp(RPL_ENDOFSTATS).Set(q).Set(":End of /STATS report").Send()
+}
@@ -0,0 +1,55 @@
+package gircd
+
+import "testing"
+
+func TestStatsNeedsOper(t *testing.T) {
+	s := newTestServer()
+	s.Opers = append(s.Opers, &OperBlock{Name: "admin", Password: "hunter2", Mask: "*@10.0.0.*"})
+	alice, conn := newTestClient(s, "alice")
+
+	for _, q := range []string{"l", "o"} {
+		testSend(alice, "STATS "+q)
+		got := conn.Lines()
+		if !hasLine(got, " 481 alice ") || hasLine(got, "alice[") || hasLine(got, "10.0.0.*") {
+			t.Errorf("STATS %s as non-oper: got %q, want only ERR_NOPRIVILEGES", q, got)
+		}
+	}
+
+	testSend(alice, "STATS u")
+	if got := conn.Lines(); !hasLine(got, " 242 alice ") {
+		t.Errorf("STATS u: got %q, want RPL_STATSUPTIME", got)
+	}
+}
+
+func TestOper(t *testing.T) {
+	s := newTestServer()
+	s.Opers = append(s.Opers, &OperBlock{Name: "admin", Password: "hunter2", Mask: "*@10.0.0.*"},
+		&OperBlock{Name: "remote", Password: "hunter2", Mask: "*@192.168.*"})
+	alice, conn := newTestClient(s, "alice")
+
+	tests := []struct {
+		Line string
+		Want string
+		Oper bool
+	}{
+		{"OPER nobody hunter2", " 491 alice ", false},
+		{"OPER remote hunter2", " 491 alice ", false},
+		{"OPER admin wrong", " 464 alice ", false},
+		{"OPER admin hunter2", " 381 alice ", true},
+	}
+
+	for _, v := range tests {
+		testSend(alice, v.Line)
+		if got := conn.Lines(); !hasLine(got, v.Want) {
+			t.Errorf("%q: got %q, want %q", v.Line, got, v.Want)
+		}
+		if alice.GlobalOp != v.Oper {
+			t.Errorf("%q: oper is %v, want %v", v.Line, alice.GlobalOp, v.Oper)
+		}
+	}
+
+	testSend(alice, "STATS o")
+	if got := conn.Lines(); !hasLine(got, " 243 alice O *@10.0.0.* * admin") {
+		t.Errorf("STATS o as oper: got %q", got)
+	}
+}
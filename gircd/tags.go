@@ -0,0 +1,147 @@
+package gircd
+
+import "sort"
+import "strconv"
+import "strings"
+import "sync/atomic"
+import "time"
+
+// Most bytes of tag data a client may send (not counting the `@` and the
+// space after the tags)
+const MAX_TAGS_SIZE = 4094
+
+// Format of the `time` tag
+const SERVER_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// Enum: Message tags
+const (
+	TAG_MSGID = "msgid"
+	TAG_TIME  = "time"
+	TAG_BATCH = "batch"
+	TAG_LABEL = "label"
+)
+
+// Capability a client needs to get a tag, tags not listed here (including
+// client-only `+tags`) need message-tags
+var TAG_CAPS = map[string]string{
+	TAG_TIME:  CAP_SERVER_TIME,
+	TAG_BATCH: CAP_BATCH,
+	TAG_LABEL: CAP_LABELED_RESPONSE,
+}
+
+var tagEscapes = strings.NewReplacer(";", "\\:", " ", "\\s", "\\", "\\\\", "\r", "\\r", "\n", "\\n")
+
+// Escapes a tag value for the wire
+func EscapeTag(v string) string {
+	return tagEscapes.Replace(v)
+}
+
+// Undoes EscapeTag, an invalid escape just drops the backslash
+func UnescapeTag(v string) string {
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+
+		// A trailing backslash is dropped
+		i += 1
+		if i == len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// Parses the tags of a message (without the leading `@`)
+func ParseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, v := range strings.Split(s, ";") {
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+		} else {
+			tags[kv[0]] = UnescapeTag(kv[1])
+		}
+	}
+	return tags
+}
+
+// Formats tags for the wire (without the leading `@`), sorted by name
+func FormatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if tags[k] == "" {
+			parts = append(parts, k)
+		} else {
+			parts = append(parts, k+"="+EscapeTag(tags[k]))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Returns true if tag `name` is client-only (e.g. `+typing`)
+func IsClientTag(name string) bool {
+	return strings.HasPrefix(name, "+")
+}
+
+// Returns the client-only tags of the message, which are relayed to other
+// clients. They are only accepted from clients with message-tags
+func (m *Msg) ClientTags() map[string]string {
+	tags := make(map[string]string)
+	if m.Client == nil || !m.Client.HasCap(CAP_MESSAGE_TAGS) {
+		return tags
+	}
+
+	for k, v := range m.Tags {
+		if IsClientTag(k) {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// Returns true if the client should get tag `name`
+func (c *Client) WantsTag(name string) bool {
+	if cp, has := TAG_CAPS[name]; has {
+		return c.HasCap(cp)
+	}
+	return c.HasCap(CAP_MESSAGE_TAGS)
+}
+
+// Returns the current time as sent in the `time` tag
+func ServerTime() string {
+	return time.Now().UTC().Format(SERVER_TIME_FORMAT)
+}
+
+// Returns a new unique message id
+func (s *Server) NewMsgID() string {
+	id := atomic.AddUint64(&s.msgid_inc, 1)
+	return s.msgid_base + "-" + strconv.FormatUint(id, 36)
+}
@@ -0,0 +1,95 @@
+package gircd
+
+import "strings"
+import "testing"
+
+func TestTagmsgRelay(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_MESSAGE_TAGS)
+	_, bobConn := newTestClient(s, "bob", CAP_MESSAGE_TAGS)
+	_, carolConn := newTestClient(s, "carol")
+
+	testSend(alice, "@+typing=active TAGMSG bob,carol")
+	got := bobConn.Lines()
+	if len(got) != 1 || !strings.HasPrefix(got[0], "@+typing=active;msgid=") ||
+		!strings.HasSuffix(got[0], " :alice!alice@10.0.0.1 TAGMSG bob") {
+		t.Errorf("message-tags peer: got %q, want the TAGMSG with +typing", got)
+	}
+
+	// TAGMSG is nothing without its tags
+	if got := carolConn.Lines(); len(got) != 0 {
+		t.Errorf("peer without message-tags got %q", got)
+	}
+	if got := conn.Lines(); len(got) != 0 {
+		t.Errorf("sender got %q", got)
+	}
+}
+
+func TestClientTagsStripped(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice", CAP_MESSAGE_TAGS)
+	plain, _ := newTestClient(s, "plain")
+	_, bobConn := newTestClient(s, "bob", CAP_MESSAGE_TAGS)
+	_, carolConn := newTestClient(s, "carol", CAP_SERVER_TIME)
+
+	tests := []struct {
+		Name   string
+		Client *Client
+		Line   string
+		Conn   *testConn
+		Has    []string
+		Hasnt  []string
+	}{
+		{"message-tags peer", alice, "@+typing=active PRIVMSG bob :hi", bobConn,
+			[]string{"+typing=active", "msgid=", " :alice!alice@10.0.0.1 PRIVMSG bob :hi"}, nil},
+		{"server-time peer", alice, "@+typing=active PRIVMSG carol :hi", carolConn,
+			[]string{"@time=", " :alice!alice@10.0.0.1 PRIVMSG carol :hi"}, []string{"+typing", "msgid="}},
+
+		// Client-only tags are only taken from clients with message-tags
+		{"sender without message-tags", plain, "@+typing=active PRIVMSG bob :hi", bobConn,
+			[]string{"msgid=", " :plain!plain@10.0.0.1 PRIVMSG bob :hi"}, []string{"+typing"}},
+	}
+
+	for _, v := range tests {
+		testSend(v.Client, v.Line)
+		got := v.Conn.Lines()
+		if len(got) != 1 {
+			t.Errorf("%s: got %q, want one line", v.Name, got)
+			continue
+		}
+		for _, want := range v.Has {
+			if !strings.Contains(got[0], want) {
+				t.Errorf("%s: got %q, want %q in it", v.Name, got[0], want)
+			}
+		}
+		for _, want := range v.Hasnt {
+			if strings.Contains(got[0], want) {
+				t.Errorf("%s: got %q, want no %q in it", v.Name, got[0], want)
+			}
+		}
+	}
+}
+
+func TestTagsSizeLimit(t *testing.T) {
+	s := newTestServer()
+	alice, conn := newTestClient(s, "alice", CAP_MESSAGE_TAGS)
+
+	// `+a=` and the value make up exactly MAX_TAGS_SIZE bytes
+	tags := "@+a=" + strings.Repeat("x", MAX_TAGS_SIZE-3)
+	alice.Feed([]byte(tags + " PING x\r\n"))
+	if got := conn.Lines(); len(got) != 0 {
+		t.Errorf("tags at the limit: got %q", got)
+	}
+	if msg := <-alice.MsgQ; msg.Tag != CLIENT_PING {
+		t.Errorf("tags at the limit: queued %q, want PING", msg.Tag)
+	}
+
+	alice.Feed([]byte(tags + "x PING x\r\n"))
+	want := ":irc.test 417 alice :Input line was too long"
+	if got := conn.Lines(); len(got) != 1 || got[0] != want {
+		t.Errorf("tags over the limit: got %q, want %q", got, want)
+	}
+	if n := len(alice.MsgQ); n != 0 {
+		t.Errorf("tags over the limit: %d messages queued", n)
+	}
+}
@@ -3,15 +3,77 @@ package gircd
 import "regexp"
 import "strings"
 
-var r, _ = regexp.Compile("(?:[a-zA-Z][a-zA-Z0-9\\-\\[\\]\\\\`^{}\\_]*)")
+// Valid nicks, a letter followed by letters, digits and specials
+var r, _ = regexp.Compile("^[a-zA-Z][a-zA-Z0-9\\-\\[\\]\\\\`^{}\\_|]*$")
 
-// Take a string s and return a sanitized version of it
+// Checks that all of `s` is a valid nick, nicks with anything else in them
+// are rejected rather than trimmed down
 func Sanatize(s string) (string, bool) {
-	v := r.FindAllString(s, -1)
-	if len(v) > 1 {
+	if !r.MatchString(s) {
 		return "", false
 	}
-	return v[0], true
+	return s, true
+}
+
+// Enum: Casemappings (advertised as ISUPPORT CASEMAPPING)
+const (
+	// `[]\~` are the uppercase forms of `{}|^`
+	CASEMAPPING_RFC1459 = "rfc1459"
+	// Like rfc1459, but `~` and `^` are distinct
+	CASEMAPPING_STRICT_RFC1459 = "strict-rfc1459"
+	// Only `A-Z` are folded
+	CASEMAPPING_ASCII = "ascii"
+)
+
+// Folds `s` following casemapping `mapping`, two names are considered the
+// same if their folded forms are equal
+func Casefold(mapping string, s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			return c + ('a' - 'A')
+		case mapping == CASEMAPPING_ASCII:
+			return c
+		case c == '[':
+			return '{'
+		case c == ']':
+			return '}'
+		case c == '\\':
+			return '|'
+		case c == '~' && mapping == CASEMAPPING_RFC1459:
+			return '^'
+		}
+		return c
+	}, s)
+}
+
+// Returns true if `s` matches the wildcard mask `mask` (`*` matches any run
+// of characters, `?` any single one). Case is significant, so fold both first
+func MatchMask(mask string, s string) bool {
+	m, v := []rune(mask), []rune(s)
+
+	mi, vi := 0, 0
+	star, mark := -1, 0
+	for vi < len(v) {
+		if mi < len(m) && (m[mi] == '?' || m[mi] == v[vi]) {
+			mi++
+			vi++
+		} else if mi < len(m) && m[mi] == '*' {
+			star, mark = mi, vi
+			mi++
+		} else if star != -1 {
+			// Backtrack, and let the last star eat one more character
+			mi = star + 1
+			mark++
+			vi = mark
+		} else {
+			return false
+		}
+	}
+	for mi < len(m) && m[mi] == '*' {
+		mi++
+	}
+	return mi == len(m)
 }
 
 type Mode struct {
@@ -33,3 +95,28 @@ func (m *Mode) RmvMode(c string) {
 		m.Modes = strings.Replace(m.Modes, c, "", -1)
 	}
 }
+
+// Joins tokens with spaces into lines of at most `max` tokens (no limit if
+// zero), keeping each line within `size` bytes
+func JoinTokens(tokens []string, max int, size int) []string {
+	lines := make([]string, 0)
+	line := make([]string, 0)
+	length := 0
+
+	for _, token := range tokens {
+		if len(line) > 0 && ((max > 0 && len(line) == max) || length+1+len(token) > size) {
+			lines = append(lines, strings.Join(line, " "))
+			line = line[:0]
+			length = 0
+		}
+		if len(line) > 0 {
+			length += 1
+		}
+		line = append(line, token)
+		length += len(token)
+	}
+	if len(line) > 0 {
+		lines = append(lines, strings.Join(line, " "))
+	}
+	return lines
+}
@@ -0,0 +1,67 @@
+package gircd
+
+import "testing"
+
+func TestSanatize(t *testing.T) {
+	tests := []struct {
+		Nick  string
+		Valid bool
+	}{
+		{"bob", true},
+		{"Bob[away]", true},
+		{"b0b_|^", true},
+		{"9bob", false},
+		{"bob!", false},
+		{"bob alice", false},
+		{"-bob", false},
+		{"", false},
+	}
+
+	for _, v := range tests {
+		n, ok := Sanatize(v.Nick)
+		if ok != v.Valid || (ok && n != v.Nick) {
+			t.Errorf("Sanatize(%q) = %q, %v, want valid %v", v.Nick, n, ok, v.Valid)
+		}
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	tests := []struct {
+		Mapping string
+		In      string
+		Want    string
+	}{
+		{CASEMAPPING_RFC1459, "Bob[A]\\~", "bob{a}|^"},
+		{CASEMAPPING_STRICT_RFC1459, "Bob[A]\\~", "bob{a}|~"},
+		{CASEMAPPING_ASCII, "Bob[A]\\~", "bob[a]\\~"},
+		{CASEMAPPING_RFC1459, "#Go", "#go"},
+	}
+
+	for _, v := range tests {
+		if got := Casefold(v.Mapping, v.In); got != v.Want {
+			t.Errorf("Casefold(%s, %q) = %q, want %q", v.Mapping, v.In, got, v.Want)
+		}
+	}
+}
+
+func TestSetCaseMapping(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "Alice[x]")
+
+	if s.SetCaseMapping("rfc8265") {
+		t.Errorf("accepted a casemapping that isn't implemented")
+	}
+	if s.CaseMapping != CASEMAPPING_RFC1459 {
+		t.Errorf("casemapping changed to %q", s.CaseMapping)
+	}
+
+	if !s.SetCaseMapping(CASEMAPPING_ASCII) {
+		t.Fatalf("refused %s", CASEMAPPING_ASCII)
+	}
+	if cl := s.FindUserByNick("alice[x]"); cl != alice {
+		t.Errorf("nick was not re-indexed under the new mapping")
+	}
+	if cl := s.FindUserByNick("alice{x}"); cl != nil {
+		t.Errorf("rfc1459 folding still applies under ascii")
+	}
+}
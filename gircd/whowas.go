@@ -0,0 +1,98 @@
+package gircd
+
+import "sync"
+import "time"
+
+const (
+	// How many entries the WHOWAS history keeps before overwriting the oldest
+	WHOWAS_SIZE = 1024
+
+	// How long a nick stays reserved for its previous owners host after they
+	//  disconnected or changed nick (nick-delay)
+	NICK_DELAY = time.Second * 30
+)
+
+// A snapshot of a clients identity at the time it left (or changed nick)
+type WhoWasEntry struct {
+	// Nick folded under the servers casemapping
+	Key string
+
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	Server   string
+	Time     time.Time
+
+	// Address the client connected from, which Host may hide
+	Addr string
+}
+
+// Bounded ring buffer of WhoWasEntry's
+type WhoWas struct {
+	Entries []WhoWasEntry
+	Lock    *sync.RWMutex
+
+	// Next index to write to, and how many entries are in use
+	next  int
+	count int
+}
+
+// Creates a new WhoWas history holding up to `size` entries
+func NewWhoWas(size int) *WhoWas {
+	return &WhoWas{
+		Entries: make([]WhoWasEntry, size),
+		Lock:    new(sync.RWMutex),
+	}
+}
+
+// Records the current identity of client `cl`
+func (w *WhoWas) Add(cl *Client) {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+
+	w.Entries[w.next] = WhoWasEntry{
+		Key:      cl.Server.Fold(cl.Nick),
+		Nick:     cl.Nick,
+		User:     cl.User,
+		Host:     cl.GetHost(),
+		RealName: cl.RealName,
+		Server:   cl.Server.GetHash(),
+		Time:     time.Now(),
+		Addr:     cl.GetAddr(),
+	}
+	w.next = (w.next + 1) % len(w.Entries)
+	if w.count < len(w.Entries) {
+		w.count += 1
+	}
+}
+
+// Returns up to `max` entries for folded nick `key` (all of them if max <= 0),
+// newest first
+func (w *WhoWas) Find(key string, max int) []WhoWasEntry {
+	w.Lock.RLock()
+	defer w.Lock.RUnlock()
+
+	result := make([]WhoWasEntry, 0)
+	for i := 1; i <= w.count; i++ {
+		e := w.Entries[(w.next-i+len(w.Entries))%len(w.Entries)]
+		if e.Key != key {
+			continue
+		}
+		result = append(result, e)
+		if max > 0 && len(result) >= max {
+			break
+		}
+	}
+	return result
+}
+
+// Returns true if folded nick `key` was recently used by someone from another
+// host than `host`, and is still being held for them
+func (w *WhoWas) IsHeld(key string, host string) bool {
+	last := w.Find(key, 1)
+	if len(last) == 0 {
+		return false
+	}
+	return last[0].Addr != host && time.Now().Sub(last[0].Time) < NICK_DELAY
+}
@@ -0,0 +1,84 @@
+package gircd
+
+import "testing"
+
+func TestWhowas(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	bob, conn := newTestClient(s, "bob")
+	testSend(alice, "NICK alice2")
+	testSend(alice, "QUIT :bye")
+
+	tests := []struct {
+		Line    string
+		Want    []string
+		NotWant []string
+	}{
+		{"WHOWAS alice", []string{
+			":irc.test 314 bob alice alice 10.0.0.1 * :Real alice",
+			" 312 bob alice irc.test ",
+			":irc.test 369 bob alice :End of WHOWAS",
+		}, nil},
+		{"WHOWAS ALICE2", []string{
+			" 314 bob alice2 alice 10.0.0.1 ",
+			" 369 bob ALICE2 ",
+		}, nil},
+		{"WHOWAS nobody", []string{
+			":irc.test 406 bob nobody :There was no such nickname",
+			" 369 bob nobody ",
+		}, []string{" 314 "}},
+		{"WHOWAS", []string{" 431 bob "}, []string{" 369 "}},
+	}
+
+	for _, v := range tests {
+		testSend(bob, v.Line)
+		got := conn.Lines()
+		for _, want := range v.Want {
+			if !hasLine(got, want) {
+				t.Errorf("%q: got %q, want %q", v.Line, got, want)
+			}
+		}
+		for _, bad := range v.NotWant {
+			if hasLine(got, bad) {
+				t.Errorf("%q: got %q, which should not have %q", v.Line, got, bad)
+			}
+		}
+	}
+}
+
+func TestWhowasRing(t *testing.T) {
+	s := newTestServer()
+	w := NewWhoWas(2)
+	alice, _ := newTestClient(s, "alice")
+	for _, nick := range []string{"alice", "bob", "alice"} {
+		alice.Nick = nick
+		w.Add(alice)
+	}
+
+	if got := len(w.Find("alice", 0)); got != 1 {
+		t.Errorf("got %d alice entries, want 1 (the oldest was overwritten)", got)
+	}
+	if got := len(w.Find("bob", 0)); got != 1 {
+		t.Errorf("got %d bob entries, want 1", got)
+	}
+}
+
+func TestNickDelay(t *testing.T) {
+	s := newTestServer()
+	alice, _ := newTestClient(s, "alice")
+	testSend(alice, "QUIT")
+
+	// Someone from another host has to wait, the previous owner doesn't
+	conn := &testConn{Addr: "10.0.0.3"}
+	eve := newTestClientOn(s, conn, "eve")
+	testSend(eve, "NICK alice")
+	if got := conn.Lines(); eve.Nick != "eve" || !hasLine(got, " 437 eve alice ") {
+		t.Errorf("held nick from another host: got %q and nick %q", got, eve.Nick)
+	}
+
+	back, _ := newTestClient(s, "back")
+	testSend(back, "NICK alice")
+	if back.Nick != "alice" {
+		t.Errorf("previous owner could not get its nick back")
+	}
+}